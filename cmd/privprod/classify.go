@@ -0,0 +1,172 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/mjolnir42/privprod/internal/privacy"
+)
+
+// runClassify implements the classify subcommand, which explains how
+// a single address is classified and returns the exit status
+func runClassify(args []string) int {
+	fs := flag.NewFlagSet(`classify`, flag.ExitOnError)
+	versions := fs.String(`versions`, os.Getenv(`PRIVACY_NETWORKMAP_VERSIONS`),
+		`versions file with the network map versions, replaces -policy and -path`)
+	policy := fs.String(`policy`, os.Getenv(`PRIVACY_POLICY_FILE`),
+		`policy file to classify with`)
+	path := fs.String(`path`, os.Getenv(`PRIVACY_NETWORKFILE_PATH`),
+		`directory with the legacy network files, used without -policy`)
+	inventory := fs.String(`inventory`, os.Getenv(`PRIVACY_INVENTORY_FILE`),
+		`inventory file with the sites and interfaces of the exporters`)
+	agent := fs.String(`agent`, ``, `AgentID of the exporter that saw the address`)
+	tstamp := fs.String(`time`, ``, `flow timestamp in RFC3339 format, defaults to now`)
+	dst := fs.Bool(`dst`, false, `classify the address as destination instead of source address`)
+	ingress := fs.Uint(`ingress`, 0, `ingress interface of the flow`)
+	egress := fs.Uint(`egress`, 0, `egress interface of the flow`)
+	direction := fs.String(`direction`, `ingress`, `flow direction, ingress or egress`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: privprod classify [flags] address\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	t := time.Now().UTC()
+	if *tstamp != `` {
+		var err error
+		if t, err = time.Parse(time.RFC3339, *tstamp); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	r := flowdata.Record{
+		AgentID:    *agent,
+		IngressIf:  uint32(*ingress),
+		EgressIf:   uint32(*egress),
+		StartMilli: t,
+		EndMilli:   t,
+	}
+	switch *direction {
+	case `ingress`:
+	case `egress`:
+		r.FlowDirection = 1
+	default:
+		fmt.Fprintf(os.Stderr, "invalid direction %s\n", *direction)
+		return 2
+	}
+
+	if err := privacy.LoadNetworkMaps(privacy.NetworkConfig{
+		VersionsFile:  *versions,
+		PolicyFile:    *policy,
+		Path:          *path,
+		InventoryFile: *inventory,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// without a pseudonym key, the classification is explained
+	// without pseudonyms
+	privacy.LoadPseudonymKeys()
+
+	x, err := privacy.ExplainFlow(fs.Arg(0), *dst, r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Address:\t%s\n", x.Address)
+	if x.AgentID != `` {
+		fmt.Fprintf(w, "AgentID:\t%s\n", x.AgentID)
+	}
+	if x.Embedded != `` {
+		fmt.Fprintf(w, "Embedded:\t%s (%s)\n", x.Embedded, x.Transition)
+	}
+	if x.Scope != `` {
+		fmt.Fprintf(w, "Scope:\t%s\n", x.Scope)
+	}
+	if x.Site != `` {
+		fmt.Fprintf(w, "Site:\t%s\n", x.Site)
+	}
+	if x.IngressName != `` || x.IngressZone != `` {
+		fmt.Fprintf(w, "Ingress:\t%s (zone %s)\n", x.IngressName, x.IngressZone)
+	}
+	if x.EgressName != `` || x.EgressZone != `` {
+		fmt.Fprintf(w, "Egress:\t%s (zone %s)\n", x.EgressName, x.EgressZone)
+	}
+	fmt.Fprintf(w, "Time:\t%s\n", x.Time.Format(time.RFC3339))
+	fmt.Fprintf(w, "Version:\t%s\n", x.Version)
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("Matching networks:")
+	if len(x.Matches) == 0 {
+		fmt.Println("  none")
+	}
+	for _, m := range x.Matches {
+		network := m.Network
+		if network == `` {
+			network = `interface rule`
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\tpriority %d\t%s\t%s\n",
+			network, m.Class, m.Actions, m.Priority,
+			strings.Join(m.Labels, `,`), m.Source)
+	}
+	w.Flush()
+
+	fmt.Println()
+	winner := x.Winner.Network
+	switch {
+	case x.Default:
+		winner = `policy default`
+	case winner == ``:
+		winner = `interface rule`
+	}
+	fmt.Fprintf(w, "Applied:\t%s (%s)\n", winner, x.Winner.Source)
+	fmt.Fprintf(w, "Class:\t%s\n", x.Winner.Class)
+	if len(x.Winner.Labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(x.Winner.Labels, `, `))
+	}
+	fmt.Fprintf(w, "Discarded:\t%t\n", x.Discard)
+	fmt.Fprintf(w, "Pseudonymized:\t%t\n", x.Pseudonymize)
+	fmt.Fprintf(w, "Encrypted:\t%t\n", x.Encrypt)
+	fmt.Fprintf(w, "IOC:\t%t\n", x.IOC != nil)
+	if x.Generalization != `` {
+		fmt.Fprintf(w, "Generalized:\t%s\n", x.Generalization)
+	}
+	switch {
+	case x.Pseudonymize && x.Pseudonym == ``:
+		fmt.Fprintf(w, "Pseudonym:\tunavailable, %s\n", x.KeyError)
+	case x.Pseudonymize:
+		fmt.Fprintf(w, "Pseudonym:\t%s (/%d, epoch %s)\n", x.Pseudonym, x.Granularity, x.Epoch)
+	}
+	w.Flush()
+
+	if x.IOC != nil {
+		jb, _ := json.Marshal(x.IOC)
+		fmt.Printf("IOC record: %s\n", jb)
+	}
+	return 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -40,11 +40,55 @@ func main() {
 		}
 	}
 	logrus.SetLevel(loglevel)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case `netcheck`:
+			os.Exit(runNetcheck(os.Args[2:]))
+		case `classify`:
+			os.Exit(runClassify(os.Args[2:]))
+		case `subject-lookup`:
+			os.Exit(runSubjectLookup(os.Args[2:]))
+		default:
+			logrus.Fatalf("Unknown command: %s\n", os.Args[1])
+		}
+	}
+
 	logrus.Infof("Starting privprod version: %s\n", privprodVersion)
 
+	if err := privacy.ReloadNetworkMaps(); err != nil {
+		logrus.Fatalln(err)
+	}
+	if err := privacy.LoadPseudonymKeys(); err != nil {
+		logrus.Fatalln(err)
+	}
+	if err := privacy.LoadAggregation(); err != nil {
+		logrus.Fatalln(err)
+	}
+	if err := privacy.LoadRiskReport(); err != nil {
+		logrus.Fatalln(err)
+	}
+
 	handlerDeath := make(chan error)
 	cancel := make(chan os.Signal, 1)
 	signal.Notify(cancel, os.Interrupt, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// network files are checked for changes in this interval
+	watchInterval := 30 * time.Second
+	if s := os.Getenv(`PRIVACY_NETWORKFILE_INTERVAL`); s != `` {
+		if watchInterval, err = time.ParseDuration(s); err != nil {
+			logrus.Fatalf("Error parsing network file interval: %s\n", err.Error())
+		}
+	}
+	var watch <-chan time.Time
+	if watchInterval > 0 {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		watch = ticker.C
+		logrus.Infof("Main: checking network files for changes every %s\n", watchInterval)
+	}
 
 	// start application handlers
 	handlerLock := sync.WaitGroup{}
@@ -88,6 +132,19 @@ runloop:
 		case <-cancel:
 			logrus.Infoln("Main: received interrupt request, exiting")
 			break runloop
+		case <-reload:
+			logrus.Infoln("Main: received SIGHUP, reloading network files")
+			if err := privacy.ReloadNetworkMaps(); err != nil {
+				logrus.Errorln(`Main: network file reload failed, keeping active maps:`, err)
+			}
+		case <-watch:
+			if !privacy.NetworkMapsChanged() {
+				continue runloop
+			}
+			logrus.Infoln("Main: network files changed, reloading")
+			if err := privacy.ReloadNetworkMaps(); err != nil {
+				logrus.Errorln(`Main: network file reload failed, keeping active maps:`, err)
+			}
 		case err := <-server.Err():
 			if err != nil {
 				logrus.Errorln(`TCPServer:`, err)
@@ -0,0 +1,56 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mjolnir42/privprod/internal/privacy"
+)
+
+// runNetcheck implements the netcheck subcommand, which checks the
+// configured network files and returns the exit status
+func runNetcheck(args []string) int {
+	fs := flag.NewFlagSet(`netcheck`, flag.ExitOnError)
+	versions := fs.String(`versions`, os.Getenv(`PRIVACY_NETWORKMAP_VERSIONS`),
+		`versions file with the network map versions to check, replaces -policy and -path`)
+	policy := fs.String(`policy`, os.Getenv(`PRIVACY_POLICY_FILE`),
+		`policy file to check`)
+	path := fs.String(`path`, os.Getenv(`PRIVACY_NETWORKFILE_PATH`),
+		`directory with the legacy network files, used without -policy`)
+	inventory := fs.String(`inventory`, os.Getenv(`PRIVACY_INVENTORY_FILE`),
+		`inventory file to check, used without -versions`)
+	strict := fs.Bool(`strict`, false, `exit with an error status on warnings`)
+	fs.Parse(args)
+
+	errors, warnings := 0, 0
+	for _, f := range privacy.CheckNetworks(privacy.NetworkConfig{
+		VersionsFile:  *versions,
+		PolicyFile:    *policy,
+		Path:          *path,
+		InventoryFile: *inventory,
+	}) {
+		fmt.Println(f.String())
+		switch f.Level {
+		case privacy.LevelError:
+			errors++
+		default:
+			warnings++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings\n", errors, warnings)
+
+	if errors > 0 || (*strict && warnings > 0) {
+		return 1
+	}
+	return 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
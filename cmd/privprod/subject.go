@@ -0,0 +1,102 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/privacy"
+	"github.com/sirupsen/logrus"
+)
+
+// runSubjectLookup implements the subject-lookup subcommand, which
+// lists the pseudonyms of the given addresses within a date range and
+// returns the exit status
+func runSubjectLookup(args []string) int {
+	fs := flag.NewFlagSet(`subject-lookup`, flag.ExitOnError)
+	versions := fs.String(`versions`, os.Getenv(`PRIVACY_NETWORKMAP_VERSIONS`),
+		`versions file with the network map versions, replaces -policy and -path`)
+	policy := fs.String(`policy`, os.Getenv(`PRIVACY_POLICY_FILE`),
+		`policy file to classify with`)
+	path := fs.String(`path`, os.Getenv(`PRIVACY_NETWORKFILE_PATH`),
+		`directory with the legacy network files, used without -policy`)
+	from := fs.String(`from`, ``, `first day of the date range, as 2006-01-02 or in RFC3339 format`)
+	to := fs.String(`to`, ``, `last day of the date range, as 2006-01-02 or in RFC3339 format`)
+	reason := fs.String(`reason`, ``, `reference of the data subject request, it is logged`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: privprod subject-lookup -from date -to date -reason ref [flags] address...\n")
+		fmt.Fprintf(fs.Output(), "The pseudonym keys are configured as for the daemon.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || *from == `` || *to == `` || *reason == `` {
+		fs.Usage()
+		return 2
+	}
+	start, err := parseDay(*from, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	end, err := parseDay(*to, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := privacy.LoadNetworkMaps(privacy.NetworkConfig{
+		VersionsFile: *versions,
+		PolicyFile:   *policy,
+		Path:         *path,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	logrus.Infof("Main: subject lookup of %d addresses from %s to %s, reason: %s\n",
+		fs.NArg(), start.Format(time.RFC3339), end.Format(time.RFC3339), *reason)
+	res, err := privacy.SubjectLookup(fs.Args(), start, end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "EPOCH\tADDRESS\tCLASS\tVERSION\tPSEUDONYM\n")
+	for _, sp := range res {
+		if sp.Error != `` {
+			fmt.Fprintf(w, "%s\t\t\t\tunavailable, %s\n", sp.Epoch, sp.Error)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/%d\n",
+			sp.Epoch, sp.Address, sp.Class, sp.Version, sp.Pseudonym, sp.Granularity)
+	}
+	w.Flush()
+	return status
+}
+
+// parseDay parses s as a date or a timestamp. Dates are the start of
+// the day, or its end if end is set.
+func parseDay(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(`2006-01-02`, s); err == nil {
+		if end {
+			return t.Add(24*time.Hour - time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,32 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package flowdata // import "github.com/mjolnir42/privprod/internal/flowdata"
+
+import "time"
+
+// Aggregate holds the differentially private traffic statistics of
+// one source class and destination service within a time window
+type Aggregate struct {
+	Start      time.Time `json:"DateTimeStart"`
+	End        time.Time `json:"DateTimeEnd"`
+	Class      string    `json:"Class"`
+	Labels     []string  `json:"Labels,omitempty"`
+	ProtocolID uint8     `json:"ProtocolID"`
+	// DstPort is zero for all ports from 1024 onwards
+	DstPort uint16 `json:"DstPort"`
+	Flows   int64  `json:"Flows"`
+	Octets  int64  `json:"OctetCount"`
+	Sources int64  `json:"DistinctSources"`
+	// Mechanism and Epsilon describe the noise added to the
+	// statistics
+	Mechanism string  `json:"Mechanism"`
+	Epsilon   float64 `json:"Epsilon"`
+	Delta     float64 `json:"Delta,omitempty"`
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
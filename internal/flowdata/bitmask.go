@@ -53,7 +53,7 @@ func (mask Bitmask) Copy() Bitmask {
 }
 
 func (mask Bitmask) String() string {
-	return fmt.Sprintf("%#04x", string(mask))
+	return fmt.Sprintf("%#04x", uint16(mask))
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
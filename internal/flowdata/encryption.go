@@ -7,33 +7,85 @@
 
 package flowdata // import "github.com/mjolnir42/privprod/internal/flowdata"
 
-// Plaintext contains the sensitive information for encryption
+import "time"
+
+// Plaintext contains the sensitive information for encryption,
+// including the values that can be generalized in published records
 type Plaintext struct {
-	RecordID   string `json:"RecordID"`
-	SrcAddress string `json:"SrcAddress"`
-	DstAddress string `json:"DstAddress"`
+	RecordID    string    `json:"RecordID"`
+	SrcAddress  string    `json:"SrcAddress"`
+	DstAddress  string    `json:"DstAddress"`
+	SrcPort     uint16    `json:"SrcPort"`
+	DstPort     uint16    `json:"DstPort"`
+	StartMilli  time.Time `json:"StartDateTimeMilli"`
+	EndMilli    time.Time `json:"EndDateTimeMilli"`
+	OctetCount  uint64    `json:"OctetCount"`
+	PacketCount uint64    `json:"PacketCount"`
 }
 
 // ExportPlaintext returns the record's data that will become encrypted
 func (r Record) ExportPlaintext() Plaintext {
 	return Plaintext{
-		RecordID:   r.RecordID,
-		SrcAddress: r.SrcAddress,
-		DstAddress: r.DstAddress,
+		RecordID:    r.RecordID,
+		SrcAddress:  r.SrcAddress,
+		DstAddress:  r.DstAddress,
+		SrcPort:     r.SrcPort,
+		DstPort:     r.DstPort,
+		StartMilli:  r.StartMilli,
+		EndMilli:    r.EndMilli,
+		OctetCount:  r.OctetCount,
+		PacketCount: r.PacketCount,
 	}
 }
 
+// Envelope versions of the encrypted messages
+const (
+	// EnvelopeCBC is the legacy envelope of records without version,
+	// AES-256-CBC with a Poly1305 signature
+	EnvelopeCBC = ``
+	// EnvelopeXChaCha20 is XChaCha20-Poly1305 with a key derived by
+	// HKDF, the salt as nonce and the other fields of the message as
+	// associated data. It has no signature.
+	EnvelopeXChaCha20 = `xchacha20-poly1305.v2`
+)
+
 // EncryptedRecord is the struct for exporting encrypted data, with the
 // value field containing an encrypted serialization of a plaintext struct
 type EncryptedRecord struct {
+	Version      string `json:"version,omitempty"`
 	RecordID     string `json:"RecordID"`
 	SessionKeyID string `json:"keyID"`
 	Salt         string `json:"salt"`
-	Signature    string `json:"signature"`
+	Signature    string `json:"signature,omitempty"`
 	Value        string `json:"value"`
 	RawSalt      []byte `json:"-"`
 	RawSignature []byte `json:"-"`
 	RawValue     []byte `json:"-"`
 }
 
+// RecordIndex maps the pseudonyms of one epoch to the records they
+// appear in
+type RecordIndex struct {
+	Epoch   string
+	Entries []IndexEntry
+}
+
+// IndexEntry lists the records that contain Pseudonym
+type IndexEntry struct {
+	Pseudonym string
+	RecordIDs []string
+}
+
+// EncryptedIndex is the struct for exporting the record index, with the
+// value field containing an encrypted serialization of a RecordIndex
+// struct. Version is the envelope version, EnvelopeXChaCha20 with the
+// version, epoch and key ID as associated data.
+type EncryptedIndex struct {
+	Version      string `json:"version"`
+	Epoch        string `json:"epoch"`
+	SessionKeyID string `json:"keyID"`
+	Salt         string `json:"salt"`
+	Value        string `json:"value"`
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -32,6 +32,13 @@ func FormatIP(addr string) string {
 	)
 }
 
+// FormatIPNative formats addr in its native address family. IPv6
+// addresses are written in the canonical text form of RFC 5952,
+// IPv4-mapped IPv6 addresses as IPv4 addresses.
+func FormatIPNative(addr string) string {
+	return net.ParseIP(strings.Trim(addr, `"`)).String()
+}
+
 func unix2time(tstp int64) time.Time {
 	return time.Unix(tstp/1000, (tstp%1000)*1000000)
 }
@@ -17,6 +17,14 @@ type IOC struct {
 	IPVersion uint8     `json:"IPVersion"`
 	Start     time.Time `json:"DateTimeStart"`
 	End       time.Time `json:"DateTimeEnd"`
+	// Site, interface names and zones of the exporter
+	Site        string `json:"Site,omitempty"`
+	IngressName string `json:"IngressName,omitempty"`
+	IngressZone string `json:"IngressZone,omitempty"`
+	EgressName  string `json:"EgressName,omitempty"`
+	EgressZone  string `json:"EgressZone,omitempty"`
+	// MapVersion is the network map version that classified Address
+	MapVersion string `json:"NetworkMapVersion,omitempty"`
 }
 
 // ToIOC exports the IOC relevant information from a record for
@@ -28,6 +36,13 @@ func (r Record) ToIOC(addr string) IOC {
 		IPVersion: r.IPVersion,
 		Start:     r.StartMilli.UTC(),
 		End:       r.EndMilli.UTC(),
+
+		Site:        r.Site,
+		IngressName: r.IngressName,
+		IngressZone: r.IngressZone,
+		EgressName:  r.EgressName,
+		EgressZone:  r.EgressZone,
+		MapVersion:  r.MapVersion,
 	}
 }
 
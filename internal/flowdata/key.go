@@ -16,6 +16,16 @@ import (
 	"golang.org/x/crypto/poly1305"
 )
 
+// Versions of the key wrapping
+const (
+	// KeyVersionLegacy is the key record without version, encrypted
+	// in AES-OFB mode once per unlock key, with a Poly1305 signature
+	KeyVersionLegacy = ``
+	// KeyVersionHPKE has one HPKE encrypted copy of the key per
+	// unlock key in Recipients
+	KeyVersionHPKE = `hpke-x25519-sha256-chacha20poly1305.v2`
+)
+
 // Key represents a session keyfile record used to encrypt records
 type Key struct {
 	ID            string `json:"keyID"`
@@ -23,11 +33,25 @@ type Key struct {
 	Value         []byte `json:"-"`
 	Salt          []byte `json:"-"`
 	PublicKey     []byte `json:"-"`
-	ExportSlotMap int    `json:"decryptionSlotMap"`
-	ExportValue   string `json:"encryptedKey"`
-	ExportSalt    string `json:"salt"`
-	ExportPubKey  string `json:"publicPeerKey"`
-	ExportSig     string `json:"signature"`
+	ExportSlotMap int    `json:"decryptionSlotMap,omitempty"`
+	ExportValue   string `json:"encryptedKey,omitempty"`
+	ExportSalt    string `json:"salt,omitempty"`
+	ExportPubKey  string `json:"publicPeerKey,omitempty"`
+	ExportSig     string `json:"signature,omitempty"`
+
+	// Version and Recipients are set for keys wrapped with HPKE
+	Version    string         `json:"version,omitempty"`
+	Recipients []KeyRecipient `json:"recipients,omitempty"`
+}
+
+// KeyRecipient is the copy of a key for one unlock key, all fields are
+// base64 encoded
+type KeyRecipient struct {
+	// PublicKey is the X25519 public key of the recipient
+	PublicKey string `json:"recipientKey"`
+	// Enc is the encapsulated HPKE key
+	Enc   string `json:"enc"`
+	Value string `json:"encryptedKey"`
 }
 
 // Serialize encodes the embedded information into new fields in a JSON
@@ -0,0 +1,38 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package flowdata // import "github.com/mjolnir42/privprod/internal/flowdata"
+
+// Linkage maps pseudonyms of one epoch to the pseudonyms of the same
+// addresses in the following epoch
+type Linkage struct {
+	FromEpoch string
+	ToEpoch   string
+	Pairs     []LinkagePair
+}
+
+// LinkagePair links the pseudonym From to the pseudonym To
+type LinkagePair struct {
+	Class string
+	From  string
+	To    string
+}
+
+// EncryptedLinkage is the struct for exporting linkage maps, with the
+// value field containing an encrypted serialization of a Linkage
+// struct. Version is the envelope version, EnvelopeXChaCha20 with the
+// version, both epochs and the key ID as associated data.
+type EncryptedLinkage struct {
+	Version      string `json:"version"`
+	FromEpoch    string `json:"fromEpoch"`
+	ToEpoch      string `json:"toEpoch"`
+	SessionKeyID string `json:"keyID"`
+	Salt         string `json:"salt"`
+	Value        string `json:"value"`
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -19,6 +19,17 @@ type Record struct {
 	SrcPort        uint16    `json:"SrcPort"`
 	DstAddress     string    `json:"DstAddress"`
 	DstPort        uint16    `json:"DstPort"`
+	SrcGranularity uint8     `json:"SrcGranularity,omitempty"`
+	DstGranularity uint8     `json:"DstGranularity,omitempty"`
+	SrcClass       string    `json:"SrcClass,omitempty"`
+	SrcLabels      []string  `json:"SrcLabels,omitempty"`
+	DstClass       string    `json:"DstClass,omitempty"`
+	DstLabels      []string  `json:"DstLabels,omitempty"`
+	PseudonymEpoch string    `json:"PseudonymEpoch,omitempty"`
+	SrcPortBucket  uint16    `json:"SrcPortBucket,omitempty"`
+	DstPortBucket  uint16    `json:"DstPortBucket,omitempty"`
+	TimeBucket     uint32    `json:"TimeBucketMilli,omitempty"`
+	CountsBucketed bool      `json:"CountsBucketed,omitempty"`
 	TcpControlBits Bitmask   `json:"TcpControlBits"`
 	TcpFlags       Flags     `json:"TcpFlags"`
 	IngressIf      uint32    `json:"-"`
@@ -27,6 +38,12 @@ type Record struct {
 	StartMilli     time.Time `json:"StartDateTimeMilli"`
 	EndMilli       time.Time `json:"EndDateTimeMilli"`
 	AgentID        string    `json:"AgentID"`
+	Site           string    `json:"Site,omitempty"`
+	IngressName    string    `json:"IngressName,omitempty"`
+	IngressZone    string    `json:"IngressZone,omitempty"`
+	EgressName     string    `json:"EgressName,omitempty"`
+	EgressZone     string    `json:"EgressZone,omitempty"`
+	MapVersion     string    `json:"NetworkMapVersion,omitempty"`
 	RecordID       string    `json:"RecordID"`
 	ExpIPv4Addr    string    `json:"-"`
 	ExpIPv6Addr    string    `json:"-"`
@@ -44,6 +61,17 @@ func (r Record) Copy() Record {
 		SrcPort:        r.SrcPort,
 		DstAddress:     r.DstAddress,
 		DstPort:        r.DstPort,
+		SrcGranularity: r.SrcGranularity,
+		DstGranularity: r.DstGranularity,
+		SrcClass:       r.SrcClass,
+		SrcLabels:      copyStrings(r.SrcLabels),
+		DstClass:       r.DstClass,
+		DstLabels:      copyStrings(r.DstLabels),
+		PseudonymEpoch: r.PseudonymEpoch,
+		SrcPortBucket:  r.SrcPortBucket,
+		DstPortBucket:  r.DstPortBucket,
+		TimeBucket:     r.TimeBucket,
+		CountsBucketed: r.CountsBucketed,
 		TcpControlBits: r.TcpControlBits.Copy(),
 		TcpFlags:       r.TcpFlags.Copy(),
 		IngressIf:      r.IngressIf,
@@ -52,9 +80,22 @@ func (r Record) Copy() Record {
 		StartMilli:     r.StartMilli,
 		EndMilli:       r.EndMilli,
 		AgentID:        r.AgentID,
+		Site:           r.Site,
+		IngressName:    r.IngressName,
+		IngressZone:    r.IngressZone,
+		EgressName:     r.EgressName,
+		EgressZone:     r.EgressZone,
+		MapVersion:     r.MapVersion,
 	}
 }
 
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
 type Flags struct {
 	NS  bool `json:"ns,string"`
 	CWR bool `json:"cwr,string"`
@@ -0,0 +1,55 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package flowdata // import "github.com/mjolnir42/privprod/internal/flowdata"
+
+import "time"
+
+// RiskReport describes how identifying the published records of a time
+// window are. Records that share their source address, destination
+// address, destination port and start time form an equivalence class;
+// records in small equivalence classes are easy to re-identify.
+type RiskReport struct {
+	Start        time.Time     `json:"DateTimeStart"`
+	End          time.Time     `json:"DateTimeEnd"`
+	Records      int64         `json:"Records"`
+	Combinations int64         `json:"Combinations"`
+	Classes      []RiskClass   `json:"Classes"`
+	Patterns     []RiskPattern `json:"Patterns"`
+	// Truncated is set if not all records of the window were counted
+	Truncated bool `json:"Truncated,omitempty"`
+}
+
+// RiskClass holds the k-anonymity of the records of one source class
+type RiskClass struct {
+	Class        string `json:"Class"`
+	Records      int64  `json:"Records"`
+	Combinations int64  `json:"Combinations"`
+	// Unique is the number of records that are the only member of
+	// their equivalence class
+	Unique int64 `json:"Unique"`
+	// MinK is the size of the smallest equivalence class
+	MinK int64 `json:"MinK"`
+	// BelowK2, BelowK5 and BelowK10 are the shares of records in
+	// equivalence classes of less than 2, 5 and 10 records
+	BelowK2  float64 `json:"BelowK2"`
+	BelowK5  float64 `json:"BelowK5"`
+	BelowK10 float64 `json:"BelowK10"`
+}
+
+// RiskPattern counts the unique records of a combination of source
+// class, destination class and service
+type RiskPattern struct {
+	SrcClass   string `json:"SrcClass"`
+	DstClass   string `json:"DstClass"`
+	ProtocolID uint8  `json:"ProtocolID"`
+	DstPort    uint16 `json:"DstPort"`
+	Records    int64  `json:"Records"`
+	Unique     int64  `json:"Unique"`
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
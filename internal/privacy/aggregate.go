@@ -0,0 +1,434 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/sirupsen/logrus"
+)
+
+// Noise mechanisms
+const (
+	mechanismLaplace  = `laplace`
+	mechanismGaussian = `gaussian`
+)
+
+// aggregateKey identifies the statistics of one source class and
+// destination service
+type aggregateKey struct {
+	class    string
+	labels   string
+	protocol uint8
+	port     uint16
+}
+
+// aggregateGroup holds the bounded contributions to one aggregateKey
+type aggregateGroup struct {
+	flows  float64
+	octets float64
+	// sources counts the flows per source address
+	sources map[string]int
+}
+
+// aggregateWindow holds the statistics of one time window
+type aggregateWindow struct {
+	start  time.Time
+	groups map[aggregateKey]*aggregateGroup
+	// services counts the groups per source address
+	services map[string]int
+}
+
+// aggregator collects the differentially private statistics of all
+// handlers per window, which protect the source addresses
+type aggregator struct {
+	window    time.Duration
+	delay     time.Duration
+	epsilon   float64
+	delta     float64
+	gaussian  bool
+	maxGroups int
+	maxFlows  int
+	maxOctets uint64
+	// threshold is the noisy count of distinct sources from which a
+	// group is published
+	threshold float64
+
+	lock    sync.Mutex
+	windows map[int64]*aggregateWindow
+	late    int
+	// watermark is the latest record start time, but never later than
+	// the current time
+	watermark time.Time
+}
+
+// noiseSource provides the random numbers of the noise
+var noiseSource io.Reader = rand.Reader
+
+// aggregates is the aggregator of all handlers, nil if aggregate
+// statistics are disabled
+var aggregates *aggregator
+
+// LoadAggregation configures the aggregate statistics from the
+// environment. It must be called before the first Protector is
+// started.
+func LoadAggregation() error {
+	var err error
+	aggregates, err = newAggregator()
+	if aggregates != nil {
+		logrus.Infof("Privacy: publishing aggregate statistics per %s with epsilon %g and delta %g, from %.1f sources\n",
+			aggregates.window, aggregates.epsilon, aggregates.delta, aggregates.threshold)
+	}
+	return err
+}
+
+// newAggregator returns the aggregator configured by the environment,
+// or nil if no privacy budget is configured
+func newAggregator() (*aggregator, error) {
+	if os.Getenv(`PRIVACY_AGGREGATE_EPSILON`) == `` {
+		return nil, nil
+	}
+	a := &aggregator{
+		window:    time.Hour,
+		delay:     5 * time.Minute,
+		delta:     1e-6,
+		maxGroups: 10,
+		maxFlows:  100,
+		maxOctets: 1000000,
+		windows:   map[int64]*aggregateWindow{},
+	}
+	var minThreshold float64
+	if err := loadEnv(
+		envSetting{`PRIVACY_AGGREGATE_EPSILON`, envFloat(&a.epsilon)},
+		envSetting{`PRIVACY_AGGREGATE_DELTA`, envFloat(&a.delta)},
+		envSetting{`PRIVACY_AGGREGATE_MECHANISM`, func(s string) error {
+			switch s {
+			case mechanismLaplace, mechanismGaussian:
+				a.gaussian = s == mechanismGaussian
+				return nil
+			}
+			return fmt.Errorf("unknown mechanism %s", s)
+		}},
+		envSetting{`PRIVACY_AGGREGATE_WINDOW`, envDuration(&a.window)},
+		envSetting{`PRIVACY_AGGREGATE_DELAY`, envDuration(&a.delay)},
+		envSetting{`PRIVACY_AGGREGATE_MAX_GROUPS`, envInt(&a.maxGroups)},
+		envSetting{`PRIVACY_AGGREGATE_MAX_FLOWS`, envInt(&a.maxFlows)},
+		envSetting{`PRIVACY_AGGREGATE_MAX_OCTETS`, envUint(&a.maxOctets)},
+		envSetting{`PRIVACY_AGGREGATE_THRESHOLD`, envFloat(&minThreshold)},
+	); err != nil {
+		return nil, err
+	}
+	switch {
+	case a.epsilon <= 0:
+		return nil, fmt.Errorf("invalid PRIVACY_AGGREGATE_EPSILON: %g", a.epsilon)
+	case a.delta <= 0 || a.delta >= 1:
+		return nil, fmt.Errorf("invalid PRIVACY_AGGREGATE_DELTA: %g", a.delta)
+	case a.window < time.Minute || a.delay < 0:
+		return nil, fmt.Errorf("invalid aggregate window %s with delay %s", a.window, a.delay)
+	case a.maxGroups < 1 || a.maxFlows < 1 || a.maxOctets < 1:
+		return nil, fmt.Errorf("invalid aggregate contribution bounds")
+	}
+	a.threshold = math.Max(a.selectionThreshold(), minThreshold)
+	return a, nil
+}
+
+// mechanism returns the name of the noise mechanism
+func (a *aggregator) mechanism() string {
+	if a.gaussian {
+		return mechanismGaussian
+	}
+	return mechanismLaplace
+}
+
+// deltaShare returns the part of delta that the selection of the
+// published groups spends, as does each statistic with the Gaussian
+// mechanism
+func (a *aggregator) deltaShare() float64 {
+	if a.gaussian {
+		return a.delta / 4
+	}
+	return a.delta
+}
+
+// scale returns the Laplace scale or the Gaussian standard deviation
+// of the noise of a statistic, to which a source contributes at most
+// sensitivity per group. Each statistic spends a third of epsilon.
+func (a *aggregator) scale(sensitivity float64) float64 {
+	eps := a.epsilon / 3
+	if a.gaussian {
+		l2 := math.Sqrt(float64(a.maxGroups)) * sensitivity
+		return l2 * math.Sqrt(2*math.Log(1.25/a.deltaShare())) / eps
+	}
+	return float64(a.maxGroups) * sensitivity / eps
+}
+
+// selectionThreshold returns the noisy count of distinct sources from
+// which a group is published. Groups exist only if a source
+// contributes to them, so a source that is the only one in its
+// maxGroups groups must reveal one of them with a probability of at
+// most the delta share.
+func (a *aggregator) selectionThreshold() float64 {
+	k := float64(a.maxGroups)
+	p := a.deltaShare() / k
+	if a.gaussian {
+		// the 1-p quantile of the normal distribution
+		return 1 + a.scale(1)*math.Sqrt2*math.Erfinv(1-2*p)
+	}
+	return 1 + a.scale(1)*math.Log(1/(2*p))
+}
+
+// add counts record r with source address src, classified by the
+// policy entry e
+func (a *aggregator) add(r *flowdata.Record, src net.IP, e *policyEntry) {
+	if a == nil {
+		return
+	}
+	key := aggregateKey{
+		class:    e.Class,
+		labels:   strings.Join(e.Labels, `,`),
+		protocol: r.ProtocolID,
+	}
+	if r.DstPort < 1024 {
+		key.port = r.DstPort
+	}
+	source := src.String()
+	start := r.StartMilli.Truncate(a.window)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if r.StartMilli.After(a.watermark) {
+		a.watermark = r.StartMilli
+		if now := time.Now(); a.watermark.After(now) {
+			a.watermark = now
+		}
+	}
+	if start.Add(a.window + a.delay).Before(a.watermark) {
+		a.late++
+		return
+	}
+	w, ok := a.windows[start.UnixNano()]
+	if !ok {
+		w = &aggregateWindow{
+			start:    start,
+			groups:   map[aggregateKey]*aggregateGroup{},
+			services: map[string]int{},
+		}
+		a.windows[start.UnixNano()] = w
+	}
+	g := w.groups[key]
+	var n int
+	known := false
+	if g != nil {
+		n, known = g.sources[source]
+	}
+	switch {
+	case !known && w.services[source] >= a.maxGroups:
+		return
+	case !known:
+		w.services[source]++
+	case n >= a.maxFlows:
+		return
+	}
+	if g == nil {
+		g = &aggregateGroup{sources: map[string]int{}}
+		w.groups[key] = g
+	}
+	g.sources[source] = n + 1
+	g.flows++
+	if r.OctetCount > a.maxOctets {
+		g.octets += float64(a.maxOctets)
+	} else {
+		g.octets += float64(r.OctetCount)
+	}
+}
+
+// closed removes and returns the windows that are complete at the
+// watermark
+func (a *aggregator) closed() []*aggregateWindow {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.watermark
+
+	done := []*aggregateWindow{}
+	for k, w := range a.windows {
+		if !w.start.Add(a.window + a.delay).After(now) {
+			done = append(done, w)
+			delete(a.windows, k)
+		}
+	}
+	if a.late > 0 {
+		logrus.Warnf("Privacy: %d records arrived after their aggregate window was published\n",
+			a.late)
+		a.late = 0
+	}
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].start.Before(done[j].start)
+	})
+	return done
+}
+
+// release returns the noisy statistics of window w. Without random
+// numbers for the noise, nothing is released.
+func (a *aggregator) release(w *aggregateWindow) ([]flowdata.Aggregate, error) {
+	// a source changes at most maxGroups groups, by at most maxFlows
+	// flows each
+	flows := float64(a.maxFlows)
+	octets := float64(a.maxFlows) * float64(a.maxOctets)
+	var err error
+	noise := func(sensitivity float64) float64 {
+		var v float64
+		switch {
+		case err != nil:
+		case a.gaussian:
+			v, err = gaussianNoise(a.scale(sensitivity))
+		default:
+			v, err = laplaceNoise(a.scale(sensitivity))
+		}
+		return v
+	}
+
+	keys := make([]aggregateKey, 0, len(w.groups))
+	for key := range w.groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		x, y := keys[i], keys[j]
+		switch {
+		case x.class != y.class:
+			return x.class < y.class
+		case x.labels != y.labels:
+			return x.labels < y.labels
+		case x.protocol != y.protocol:
+			return x.protocol < y.protocol
+		}
+		return x.port < y.port
+	})
+
+	res := []flowdata.Aggregate{}
+	for _, key := range keys {
+		g := w.groups[key]
+		sources := float64(len(g.sources)) + noise(1)
+		if sources < a.threshold {
+			continue
+		}
+		agg := flowdata.Aggregate{
+			Start:      w.start.UTC(),
+			End:        w.start.Add(a.window).UTC(),
+			Class:      key.class,
+			ProtocolID: key.protocol,
+			DstPort:    key.port,
+			Flows:      clampRound(g.flows + noise(flows)),
+			Octets:     clampRound(g.octets + noise(octets)),
+			Sources:    clampRound(sources),
+			Mechanism:  a.mechanism(),
+			Epsilon:    a.epsilon,
+			Delta:      a.delta,
+		}
+		if key.labels != `` {
+			agg.Labels = strings.Split(key.labels, `,`)
+		}
+		res = append(res, agg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// publishAggregates publishes the statistics of the windows done
+func (p *Protector) publishAggregates(done []*aggregateWindow) {
+	if p.topicAGG == `` {
+		logrus.Warnln(`Privacy: no kafka topic for aggregate statistics configured`)
+		return
+	}
+	for _, w := range done {
+		aggs, err := aggregates.release(w)
+		if err != nil {
+			logrus.Errorln(`privacy.Protector.publishAggregates: ` + err.Error())
+			continue
+		}
+		for _, agg := range aggs {
+			jb, err := json.Marshal(&agg)
+			if err != nil {
+				logrus.Errorln(`privacy.Protector.publishAggregates: ` + err.Error())
+				continue
+			}
+			p.dispatch <- &sarama.ProducerMessage{
+				Topic: p.topicAGG,
+				Value: sarama.ByteEncoder(jb),
+			}
+		}
+	}
+}
+
+// uniform returns a uniformly distributed random number in (0, 1)
+func uniform() (float64, error) {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(noiseSource, b[:]); err != nil {
+			return 0, err
+		}
+		// 53 random bits
+		u := float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+		if u > 0 {
+			return u, nil
+		}
+	}
+}
+
+// laplaceNoise returns a sample of the Laplace distribution with scale b
+func laplaceNoise(b float64) (float64, error) {
+	u, err := uniform()
+	if err != nil {
+		return 0, err
+	}
+	if u -= 0.5; u < 0 {
+		return b * math.Log(1+2*u), nil
+	}
+	return -b * math.Log(1-2*u), nil
+}
+
+// gaussianNoise returns a sample of the normal distribution with
+// standard deviation sigma
+func gaussianNoise(sigma float64) (float64, error) {
+	u1, err := uniform()
+	if err != nil {
+		return 0, err
+	}
+	u2, err := uniform()
+	if err != nil {
+		return 0, err
+	}
+	return sigma * math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2), nil
+}
+
+// clampRound rounds v to the nearest non-negative integer
+func clampRound(v float64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return int64(math.Round(v))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
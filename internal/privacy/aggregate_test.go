@@ -0,0 +1,147 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestAggregateBounds(t *testing.T) {
+	a := &aggregator{
+		window:    time.Hour,
+		delay:     time.Minute,
+		epsilon:   1e9,
+		maxGroups: 2,
+		maxFlows:  3,
+		maxOctets: 1000,
+		// clearly between the one and two sources of the services
+		threshold: 1.5,
+		windows:   map[int64]*aggregateWindow{},
+	}
+	e := &policyEntry{Class: classEmployeePriv, Labels: []string{`vpn`}}
+	now := time.Date(2021, 7, 14, 10, 30, 0, 0, time.UTC)
+
+	// one source in three services, with five flows each
+	src := net.ParseIP(`10.0.0.1`)
+	for _, port := range []uint16{443, 22, 25} {
+		for i := 0; i < 5; i++ {
+			a.add(&flowdata.Record{StartMilli: now, ProtocolID: 6, DstPort: port, OctetCount: 5000}, src, e)
+		}
+	}
+	// a second source, in a service of the first one
+	a.add(&flowdata.Record{StartMilli: now, ProtocolID: 6, DstPort: 443, OctetCount: 10}, net.ParseIP(`10.0.0.2`), e)
+	// ephemeral ports are counted as port 0
+	a.add(&flowdata.Record{StartMilli: now, ProtocolID: 6, DstPort: 50000}, net.ParseIP(`10.0.0.3`), e)
+
+	if done := a.closed(); len(done) != 0 {
+		t.Fatalf("open window published")
+	}
+	// the window closes when the record stream passes its end
+	a.add(&flowdata.Record{StartMilli: now.Add(2 * time.Hour), ProtocolID: 17, DstPort: 53}, src, e)
+	done := a.closed()
+	if len(done) != 1 {
+		t.Fatalf("%d windows published, want 1", len(done))
+	}
+	a.add(&flowdata.Record{StartMilli: now, ProtocolID: 6, DstPort: 443}, src, e)
+	if a.late != 1 {
+		t.Errorf("record of a published window counted")
+	}
+
+	res := map[string]flowdata.Aggregate{}
+	aggs, err := a.release(done[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agg := range aggs {
+		res[fmt.Sprintf("%d/%d", agg.ProtocolID, agg.DstPort)] = agg
+	}
+	if len(res) != 1 {
+		t.Fatalf("published %d services, want only the one above the threshold", len(res))
+	}
+	agg := res[`6/443`]
+	if agg.Flows != 4 || agg.Octets != 3010 || agg.Sources != 2 || agg.Class != classEmployeePriv {
+		t.Errorf("unexpected statistics %+v", agg)
+	}
+	if len(a.windows) != 1 {
+		t.Errorf("%d windows kept, want the open one", len(a.windows))
+	}
+}
+
+func TestAggregateNoiseFailure(t *testing.T) {
+	a := &aggregator{window: time.Hour, epsilon: 1, maxGroups: 1, maxFlows: 1, maxOctets: 1,
+		windows: map[int64]*aggregateWindow{}}
+	now := time.Date(2021, 7, 14, 10, 30, 0, 0, time.UTC)
+	a.add(&flowdata.Record{StartMilli: now, ProtocolID: 6, DstPort: 443}, net.ParseIP(`10.0.0.1`),
+		&policyEntry{Class: classEmployeePriv})
+	a.add(&flowdata.Record{StartMilli: now.Add(2 * time.Hour)}, net.ParseIP(`10.0.0.1`),
+		&policyEntry{Class: classEmployeePriv})
+	done := a.closed()
+
+	defer func(r io.Reader) { noiseSource = r }(noiseSource)
+	noiseSource = strings.NewReader(`short`)
+	if res, err := a.release(done[0]); err == nil || res != nil {
+		t.Errorf("released %v without noise", res)
+	}
+}
+
+func TestAggregateThreshold(t *testing.T) {
+	for _, a := range []*aggregator{
+		{epsilon: 3, delta: 1e-6, maxGroups: 1},
+		{epsilon: 0.3, delta: 1e-8, maxGroups: 10},
+		{epsilon: 3, delta: 1e-6, maxGroups: 1, gaussian: true},
+		{epsilon: 0.3, delta: 1e-8, maxGroups: 10, gaussian: true},
+	} {
+		// the probability that the noisy count of a group of a single
+		// source reaches the threshold, times the groups of the source
+		tau := a.selectionThreshold()
+		var p float64
+		if a.gaussian {
+			p = math.Erfc((tau-1)/(a.scale(1)*math.Sqrt2)) / 2
+		} else {
+			p = math.Exp(-(tau-1)/a.scale(1)) / 2
+		}
+		if d := p * float64(a.maxGroups); math.Abs(d-a.deltaShare()) > 1e-3*a.deltaShare() {
+			t.Errorf("%s with epsilon %g: threshold %g releases a single source with probability %g, want %g",
+				a.mechanism(), a.epsilon, tau, d, a.deltaShare())
+		}
+	}
+	a := &aggregator{epsilon: 3, delta: 1e-6, maxGroups: 1}
+	if tau := a.selectionThreshold(); math.Abs(tau-(1+math.Log(5e5))) > 1e-9 {
+		t.Errorf("Laplace threshold %g", tau)
+	}
+}
+
+func TestLaplaceNoise(t *testing.T) {
+	const n, b = 20000, 4.0
+	var sum, abs float64
+	for i := 0; i < n; i++ {
+		v, err := laplaceNoise(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum += v
+		abs += math.Abs(v)
+	}
+	// the mean is 0 and the mean absolute deviation b
+	if mean := sum / n; math.Abs(mean) > 0.2 {
+		t.Errorf("mean %f, want 0", mean)
+	}
+	if mad := abs / n; math.Abs(mad-b) > 0.2 {
+		t.Errorf("mean absolute deviation %f, want %f", mad, b)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
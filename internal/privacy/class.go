@@ -0,0 +1,288 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names of the builtin classes
+const (
+	classEmployeePriv   = `employee-private`
+	classEmployeePub    = `employee-public`
+	classCustomer       = `customer`
+	classInfrastructure = `infrastructure`
+	classPartner        = `partner`
+	classDiscard        = `discard`
+	classSpecialPurpose = `special-purpose`
+)
+
+// Pseudonymization modes of a class
+const (
+	// modeHash replaces the address with a keyed hash below the
+	// prefix of the class
+	modeHash = `hash`
+	// modePrefixPreserving replaces the address with a Crypto-PAn
+	// pseudonym of the same family, that preserves common prefixes
+	// between addresses
+	modePrefixPreserving = `prefix-preserving`
+)
+
+// policyClass is a class of addresses. Policy entries of the class
+// use its actions unless they configure their own.
+type policyClass struct {
+	Name string
+	// Prefix are the first two groups of the pseudonyms of the class,
+	// empty if the class does not support pseudonymization
+	Prefix string
+	Mode   string
+	// Granularity4 and Granularity6 are the prefix lengths at which
+	// IPv4 and IPv6 addresses are pseudonymized, zero for the full
+	// address
+	Granularity4 int
+	Granularity6 int
+	// Range4 is the network IPv4 pseudonyms are taken from, nil for
+	// IPv6 pseudonyms of IPv4 addresses
+	Range4  *net.IPNet
+	Actions actionSet
+	// Generalize coarsens the published records of the class
+	Generalize generalization
+	Source     string
+}
+
+// builtinClasses returns the classes that are always defined. A policy
+// file can change their prefixes and actions.
+func builtinClasses() map[string]*policyClass {
+	classes := map[string]*policyClass{}
+	for _, c := range []policyClass{
+		{Name: classEmployeePriv, Prefix: `0100:a000`, Actions: actPseudonymize | actEncrypt},
+		{Name: classEmployeePub, Prefix: `0100:b000`, Actions: actPseudonymize | actEncrypt},
+		{Name: classCustomer, Prefix: `0100:c000`, Actions: actPseudonymize | actEncrypt | actIOC},
+		{Name: classInfrastructure, Prefix: `0100:d000`, Actions: actPseudonymize | actEncrypt},
+		{Name: classPartner, Prefix: `0100:e000`, Actions: actPseudonymize | actEncrypt},
+		{Name: classDiscard, Actions: actDiscard},
+		{Name: classSpecialPurpose, Actions: actPass},
+	} {
+		c := c
+		c.Mode = modeHash
+		c.Source = `builtin class`
+		classes[c.Name] = &c
+	}
+	return classes
+}
+
+// policyFileClass is the JSON representation of a class definition
+type policyFileClass struct {
+	Name    string   `json:"name"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+	Actions []string `json:"actions,omitempty"`
+	// Range4 is the network of format-preserving IPv4 pseudonyms
+	Range4 string `json:"ipv4range,omitempty"`
+	// Granularity configures the prefix lengths at which addresses
+	// are pseudonymized
+	Granularity *struct {
+		IPv4 int `json:"ipv4"`
+		IPv6 int `json:"ipv6"`
+	} `json:"granularity,omitempty"`
+	Generalize *policyFileGeneralization `json:"generalize,omitempty"`
+}
+
+// define adds the class definition pfc to classes, or changes the
+// builtin class of the same name
+func (pfc *policyFileClass) define(classes map[string]*policyClass, source string) error {
+	if pfc.Name == `` {
+		return errAt(source, `class without name`)
+	}
+	c, ok := classes[pfc.Name]
+	switch {
+	case !ok:
+		if len(pfc.Actions) == 0 {
+			return errAt(source, fmt.Sprintf("class %s: no actions configured", pfc.Name))
+		}
+		c = &policyClass{Name: pfc.Name, Mode: modeHash}
+	case c.Source != `builtin class`:
+		return errAt(source, fmt.Sprintf("duplicate class %s, first defined at %s",
+			pfc.Name, c.Source))
+	default:
+		// do not modify the builtin definition
+		cp := *c
+		c = &cp
+	}
+	c.Source = source
+
+	var err error
+	if pfc.Prefix != `` {
+		if c.Prefix, err = parsePseudonymPrefix(pfc.Prefix); err != nil {
+			return errAt(source, fmt.Sprintf("class %s: %s", pfc.Name, err.Error()))
+		}
+	}
+	switch pfc.Mode {
+	case ``:
+	case modeHash, modePrefixPreserving:
+		c.Mode = pfc.Mode
+	default:
+		return errAt(source, fmt.Sprintf("class %s: unknown mode %s", pfc.Name, pfc.Mode))
+	}
+	if g := pfc.Granularity; g != nil {
+		if g.IPv4 < 0 || g.IPv4 > 32 || g.IPv6 < 0 || g.IPv6 > 128 {
+			return errAt(source, fmt.Sprintf("class %s: invalid granularity /%d, /%d",
+				pfc.Name, g.IPv4, g.IPv6))
+		}
+		c.Granularity4, c.Granularity6 = g.IPv4, g.IPv6
+	}
+	if pfc.Range4 != `` {
+		_, c.Range4, err = net.ParseCIDR(pfc.Range4)
+		switch {
+		case err != nil:
+			return errAt(source, fmt.Sprintf("class %s: %s", pfc.Name, err.Error()))
+		case c.Range4.IP.To4() == nil:
+			return errAt(source, fmt.Sprintf("class %s: ipv4range %s is not an IPv4 network",
+				pfc.Name, pfc.Range4))
+		}
+	}
+	if pfc.Generalize != nil {
+		if c.Generalize, err = pfc.Generalize.parse(); err != nil {
+			return errAt(source, fmt.Sprintf("class %s: %s", pfc.Name, err.Error()))
+		}
+	}
+	if len(pfc.Actions) > 0 {
+		if c.Actions, err = parseActions(pfc.Actions); err != nil {
+			return errAt(source, fmt.Sprintf("class %s: %s", pfc.Name, err.Error()))
+		}
+	}
+	switch {
+	case c.Actions.has(actPseudonymize) && !c.pseudonymizes():
+		return errAt(source, fmt.Sprintf(
+			"class %s: pseudonymization requires a prefix", pfc.Name))
+	case c.Name == classSpecialPurpose && c.Actions != actDiscard && c.Actions != actPass:
+		return errAt(source, fmt.Sprintf(
+			"class %s: only discard or pass are supported", pfc.Name))
+	case c.Range4 != nil && c.Mode != modeHash:
+		return errAt(source, fmt.Sprintf(
+			"class %s: ipv4range requires mode %s", pfc.Name, modeHash))
+	}
+	classes[c.Name] = c
+	return nil
+}
+
+// parsePseudonymPrefix validates a pseudonym prefix of two hexadecimal
+// IPv6 address groups and returns it in its zero padded form
+func parsePseudonymPrefix(s string) (string, error) {
+	groups := strings.Split(s, `:`)
+	if len(groups) != 2 {
+		return ``, fmt.Errorf("invalid prefix %s, expected two address groups", s)
+	}
+	var v [2]uint64
+	for i, g := range groups {
+		var err error
+		if len(g) == 0 || len(g) > 4 {
+			return ``, fmt.Errorf("invalid prefix %s", s)
+		}
+		if v[i], err = strconv.ParseUint(g, 16, 16); err != nil {
+			return ``, fmt.Errorf("invalid prefix %s", s)
+		}
+	}
+	return fmt.Sprintf("%04x:%04x", v[0], v[1]), nil
+}
+
+// checkClasses verifies that no two classes share a pseudonym prefix
+// or IPv4 range, which would make their pseudonyms indistinguishable
+func checkClasses(classes map[string]*policyClass) []error {
+	names := []string{}
+	for name := range classes {
+		names = append(names, name)
+	}
+	// report the conflict at the class defined in the policy file
+	sort.Slice(names, func(i, j int) bool {
+		bi := classes[names[i]].Source == `builtin class`
+		bj := classes[names[j]].Source == `builtin class`
+		if bi != bj {
+			return bi
+		}
+		return names[i] < names[j]
+	})
+
+	errs := []error{}
+	prefixes := map[string]string{}
+	ranges := []*policyClass{}
+	for _, name := range names {
+		c := classes[name]
+		if c.Range4 != nil {
+			for _, o := range ranges {
+				if intersect(c.Range4, o.Range4) != nil {
+					errs = append(errs, errAt(c.Source, fmt.Sprintf(
+						"class %s uses ipv4range %s overlapping %s of class %s",
+						c.Name, c.Range4, o.Range4, o.Name)))
+				}
+			}
+			ranges = append(ranges, c)
+		}
+		if c.Prefix == `` || c.Mode == modePrefixPreserving {
+			continue
+		}
+		if other, ok := prefixes[c.Prefix]; ok {
+			errs = append(errs, errAt(c.Source, fmt.Sprintf(
+				"class %s uses the same prefix %s as class %s",
+				c.Name, c.Prefix, other)))
+			continue
+		}
+		prefixes[c.Prefix] = c.Name
+	}
+	return errs
+}
+
+// pseudonymizes reports if addresses of the class can be pseudonymized
+func (c *policyClass) pseudonymizes() bool {
+	return c.Prefix != `` || c.Mode == modePrefixPreserving
+}
+
+// granularity returns the prefix length at which ip is pseudonymized
+// and the length of its address family
+func (c *policyClass) granularity(ip net.IP) (int, int) {
+	plen, bits := c.Granularity6, 128
+	if ip.To4() != nil {
+		plen, bits = c.Granularity4, 32
+	}
+	if plen == 0 {
+		plen = bits
+	}
+	return plen, bits
+}
+
+// format returns the pseudonym of the class for hash b
+func (c *policyClass) format(b []byte) string {
+	return fmt.Sprintf(
+		"%s:%x:%x:%x:%x:%x:%x",
+		c.Prefix,
+		b[4:6],
+		b[6:8],
+		b[8:10],
+		b[10:12],
+		b[12:14],
+		b[14:16],
+	)
+}
+
+// formatIPv4 returns the IPv4 pseudonym of the class for hash b,
+// within Range4. Since the pseudonym has less bits than the hash,
+// smaller ranges make collisions between pseudonyms more likely.
+func (c *policyClass) formatIPv4(b []byte) string {
+	network := c.Range4.IP.To4()
+	res := make(net.IP, net.IPv4len)
+	for i := range res {
+		res[i] = network[i] | b[i]&^c.Range4.Mask[i]
+	}
+	return res.String()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,75 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinClassActions(t *testing.T) {
+	classes := builtinClasses()
+	for _, c := range []struct {
+		name, prefix string
+		actions      actionSet
+	}{
+		{classEmployeePriv, `0100:a000`, actPseudonymize | actEncrypt},
+		{classEmployeePub, `0100:b000`, actPseudonymize | actEncrypt},
+		{classCustomer, `0100:c000`, actPseudonymize | actEncrypt | actIOC},
+		{classInfrastructure, `0100:d000`, actPseudonymize | actEncrypt},
+		{classPartner, `0100:e000`, actPseudonymize | actEncrypt},
+		{classDiscard, ``, actDiscard},
+		{classSpecialPurpose, ``, actPass},
+	} {
+		pc, ok := classes[c.name]
+		switch {
+		case !ok:
+			t.Errorf("%s: not defined", c.name)
+		case pc.Actions != c.actions:
+			t.Errorf("%s: actions %s, want %s", c.name, pc.Actions, c.actions)
+		case pc.Prefix != c.prefix:
+			t.Errorf("%s: prefix %s, want %s", c.name, pc.Prefix, c.prefix)
+		case pc.Mode != modeHash:
+			t.Errorf("%s: mode %s, want %s", c.name, pc.Mode, modeHash)
+		}
+	}
+	if len(classes) != 7 {
+		t.Errorf("%d builtin classes, want 7", len(classes))
+	}
+}
+
+func TestUnclassifiedNotPassed(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`policy.json`: `{"networks": [{"prefix": "192.0.2.0/24", "class": "infrastructure"}]}`,
+	})
+	m, _, err := loadPolicyFile(filepath.Join(dir, `policy.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// addresses without an entry, including private-use address space
+	// outside the special-purpose registry
+	for _, s := range []string{`8.8.8.8`, `10.1.2.3`, `172.16.0.1`,
+		`192.168.1.1`, `100.64.0.1`, `2a00:1450::1`, `fd12:3456::1`} {
+		e := m.lookup(net.ParseIP(s))
+		if e != m.fallback {
+			t.Errorf("%s: matched %s", s, e.Source)
+		}
+		if e.Actions.has(actPass) || !e.Actions.has(actPseudonymize) {
+			t.Errorf("%s: unclassified address with actions %s", s, e.Actions)
+		}
+	}
+	if m.fallback.Class != classCustomer {
+		t.Errorf("default class %s, want %s", m.fallback.Class, classCustomer)
+	}
+	if e := newNetworkMap().lookup(net.ParseIP(`8.8.8.8`)); e.Actions.has(actPass) {
+		t.Errorf("empty network map passes addresses in cleartext")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
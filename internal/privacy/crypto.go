@@ -10,17 +10,34 @@ package privacy
 import (
 	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"strings"
 
 	"github.com/aead/ecdh"
 	"github.com/jorrizza/ed2curve25519"
-	"golang.org/x/crypto/argon2"
+	"github.com/mjolnir42/privprod/internal/flowdata"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/poly1305"
 )
 
+// recordKeyInfo is the HKDF info that derives the record encryption
+// key from the session key
+const recordKeyInfo = `privprod record key ` + flowdata.EnvelopeXChaCha20
+
 var (
 	// ErrInvalidBlockSize indicates hash blocksize <= 0
 	ErrInvalidBlockSize = errors.New("invalid blocksize")
@@ -34,6 +51,10 @@ var (
 
 	// ErrInvalidPKCS7Padding indicates PKCS7 unpad fails to bad input.
 	ErrInvalidPKCS7Padding = errors.New("invalid padding on input")
+
+	// ErrAuthentication indicates that an encrypted message was
+	// modified or decrypted with the wrong key
+	ErrAuthentication = errors.New("message authentication failed")
 )
 
 // pad implements pkcs7 padding of []byte
@@ -81,42 +102,169 @@ func pubKeyBytes(a crypto.PublicKey) []byte {
 	return b[:]
 }
 
-// genKeyedSalt returns a new 128 bit salt from hashing a public key with
-// another salt, allowing the generation of key-specific salts when the
-// same encryption is performed with multiple keys
-func genKeyedSalt(pubkey crypto.PublicKey, salt []byte) ([]byte, error) {
-	// compute derived salt from public key and common salt
-	b2, err := blake2b.New512(nil)
+// macCBC returns the Poly1305 signature of a ciphertext of the legacy
+// CBC envelope over header, the base64 encoded salt and the base64
+// encoded ciphertext
+func macCBC(salt, value []byte, header ...string) ([]byte, error) {
+	// calculate hash of the ciphertext for use as authentication key
+	b64Salt := base64.StdEncoding.EncodeToString(salt)
+	b64Value := base64.StdEncoding.EncodeToString(value)
+	b2, err := blake2b.New256(nil)
 	if err != nil {
 		return nil, err
 	}
-	b2.Write(pubKeyBytes(pubkey))
-	b2.Write(salt)
-	derived := b2.Sum(nil)
-	// truncate 128 bit
-	return derived[:16], nil
+	b2.Write([]byte(b64Value))
+	var polyKey [32]byte
+	var polyMAC [16]byte
+	copy(polyKey[:], b2.Sum(nil))
+
+	// calculate MAC over the output encoded fields instead of the raw
+	// []byte fields, so that receiver verification can work directly on
+	// received data
+	fields := [][]byte{}
+	for _, h := range header {
+		fields = append(fields, []byte(h))
+	}
+	fields = append(fields, []byte(b64Salt), []byte(b64Value))
+	poly1305.Sum(&polyMAC, bytes.Join(fields, nil), &polyKey)
+	return polyMAC[:], nil
 }
 
-// deriveKey returns 32 bytes that are suitable for use as 256 bit key
-// material, derived from the keys' shared secret
-func deriveKey(sessionPriv crypto.PrivateKey, lockPub crypto.PublicKey, salt []byte) ([]byte, error) {
-	// compute derived salt from public key and common salt using a keyed
-	// hash with the pubkey as key
-	b2, err := blake2b.New512(pubKeyBytes(lockPub))
+// openCBC verifies and decrypts a ciphertext of the legacy CBC envelope.
+// Only records encrypted before the AEAD envelope use it, nothing is
+// sealed in this format anymore.
+func openCBC(key, salt, value, sig []byte, header ...string) ([]byte, error) {
+	mac, err := macCBC(salt, value, header...)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, sig) {
+		return nil, ErrAuthentication
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	b2.Write(pubKeyBytes(lockPub))
-	b2.Write(salt)
-	derived := b2.Sum(nil)
+	if len(salt) != block.BlockSize() || len(value)%block.BlockSize() != 0 {
+		return nil, ErrInvalidPKCS7Padding
+	}
+	raw := make([]byte, len(value))
+	cipher.NewCBCDecrypter(block, salt).CryptBlocks(raw, value)
+	return unpad(raw, block.BlockSize())
+}
+
+// newAEAD returns the XChaCha20-Poly1305 cipher keyed from key by
+// HKDF with info, which separates the keys of different purposes
+func newAEAD(key []byte, info string) (cipher.AEAD, error) {
+	aeadKey := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, key, nil, []byte(info))
+	if _, err := io.ReadFull(kdf, aeadKey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(aeadKey)
+}
+
+// recordAEAD returns the XChaCha20-Poly1305 cipher of the records
+// encrypted with sessionKey
+func recordAEAD(sessionKey []byte) (cipher.AEAD, error) {
+	return newAEAD(sessionKey, recordKeyInfo)
+}
+
+// associatedData returns the length prefixed concatenation of fields
+func associatedData(fields ...string) []byte {
+	ad := []byte{}
+	for _, f := range fields {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(f)))
+		ad = append(ad, l[:]...)
+		ad = append(ad, f...)
+	}
+	return ad
+}
 
-	// compute raw ECDH secret over Curve25519
-	kex := ecdh.X25519()
-	secret := kex.ComputeSecret(sessionPriv, lockPub)
+// sealAEAD encrypts raw with aead and a random nonce, authenticating
+// the fields ad as associated data. It returns the nonce and the
+// ciphertext.
+func sealAEAD(aead cipher.AEAD, raw []byte, ad ...string) ([]byte, []byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, raw, associatedData(ad...)), nil
+}
 
-	// for use as AES-256 key, extract a uniformly distributed key out of
-	// the shared secret using a key derivation function
-	return argon2.IDKey(secret, derived, 1, 64*1024, 4, 32), nil
+// openAEAD verifies and decrypts a ciphertext of sealAEAD
+func openAEAD(aead cipher.AEAD, nonce, value []byte, ad ...string) ([]byte, error) {
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	raw, err := aead.Open(nil, nonce, value, associatedData(ad...))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return raw, nil
+}
+
+// sealRecord encrypts raw into e with aead, using a random nonce as
+// salt. The envelope version, e.RecordID and e.SessionKeyID are
+// authenticated, the latter two must be set.
+func sealRecord(aead cipher.AEAD, raw []byte, e *flowdata.EncryptedRecord) error {
+	e.Version = flowdata.EnvelopeXChaCha20
+	var err error
+	e.RawSalt, e.RawValue, err = sealAEAD(aead, raw, e.Version, e.RecordID, e.SessionKeyID)
+	if err != nil {
+		return err
+	}
+	e.RawSignature = nil
+	e.Salt = base64.StdEncoding.EncodeToString(e.RawSalt)
+	e.Value = base64.StdEncoding.EncodeToString(e.RawValue)
+	e.Signature = ``
+	return nil
+}
+
+// OpenRecord verifies and decrypts encrypted record e with the session
+// key it was encrypted with. It reads all envelope versions, including
+// the legacy AES-CBC records without version.
+func OpenRecord(sessionKey []byte, e *flowdata.EncryptedRecord) (*flowdata.Plaintext, error) {
+	salt, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	value, err := base64.StdEncoding.DecodeString(e.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch e.Version {
+	case flowdata.EnvelopeXChaCha20:
+		aead, err := recordAEAD(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = openAEAD(aead, salt, value, e.Version, e.RecordID, e.SessionKeyID); err != nil {
+			return nil, err
+		}
+	case flowdata.EnvelopeCBC:
+		sig, err := base64.StdEncoding.DecodeString(e.Signature)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = openCBC(sessionKey, salt, value, sig, e.RecordID, e.SessionKeyID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported envelope version: %s", e.Version)
+	}
+
+	plain := &flowdata.Plaintext{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(plain); err != nil {
+		return nil, err
+	}
+	if plain.RecordID != e.RecordID {
+		return nil, fmt.Errorf("record ID mismatch: %s", plain.RecordID)
+	}
+	return plain, nil
 }
 
 // decodePKString takes a hex encoded Ed25519 public key and
@@ -0,0 +1,132 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"testing"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func testPlaintext(t *testing.T) (flowdata.Plaintext, []byte) {
+	plain := flowdata.Plaintext{
+		RecordID:   `3f6b6e4c-4f0a-4a63-9d0e-6d1c5b0c8a11`,
+		SrcAddress: `10.0.0.1`,
+		DstAddress: `192.0.2.1`,
+		DstPort:    443,
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(plain); err != nil {
+		t.Fatal(err)
+	}
+	return plain, buf.Bytes()
+}
+
+func TestRecordEnvelope(t *testing.T) {
+	plain, raw := testPlaintext(t)
+	key := bytes.Repeat([]byte{0x42}, keyLenBytes)
+	aead, err := recordAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := flowdata.EncryptedRecord{RecordID: plain.RecordID, SessionKeyID: `session`}
+	if err := sealRecord(aead, raw, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != flowdata.EnvelopeXChaCha20 || e.Signature != `` {
+		t.Fatalf("unexpected envelope: %+v", e)
+	}
+	res, err := OpenRecord(key, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != plain {
+		t.Errorf("decrypted %+v, want %+v", *res, plain)
+	}
+
+	// the associated data is authenticated
+	for _, f := range []func(e *flowdata.EncryptedRecord){
+		func(e *flowdata.EncryptedRecord) { e.RecordID = `other` },
+		func(e *flowdata.EncryptedRecord) { e.SessionKeyID = `other` },
+		func(e *flowdata.EncryptedRecord) { e.Version = `other` },
+	} {
+		m := e
+		f(&m)
+		if _, err := OpenRecord(key, &m); err == nil {
+			t.Errorf("modified envelope decrypted: %+v", m)
+		}
+	}
+	if _, err := OpenRecord(bytes.Repeat([]byte{0x43}, keyLenBytes), &e); err != ErrAuthentication {
+		t.Errorf("decrypted with the wrong key: %v", err)
+	}
+}
+
+func TestRecordEnvelopeLegacy(t *testing.T) {
+	plain, raw := testPlaintext(t)
+	key := bytes.Repeat([]byte{0x42}, keyLenBytes)
+	e := flowdata.EncryptedRecord{RecordID: plain.RecordID, SessionKeyID: `session`}
+	salt, value, sig, err := sealCBC(key, raw, e.RecordID, e.SessionKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Salt = base64.StdEncoding.EncodeToString(salt)
+	e.Value = base64.StdEncoding.EncodeToString(value)
+	e.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	res, err := OpenRecord(key, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != plain {
+		t.Errorf("decrypted %+v, want %+v", *res, plain)
+	}
+	e.SessionKeyID = `other`
+	if _, err := OpenRecord(key, &e); err != ErrAuthentication {
+		t.Errorf("modified legacy envelope decrypted: %v", err)
+	}
+}
+
+// sealCBC encrypts raw in the legacy CBC envelope, with a random salt
+// as IV.
+// It returns the salt, the ciphertext and the Poly1305 signature over
+// header, the base64 encoded salt and the base64 encoded ciphertext.
+func sealCBC(key, raw []byte, header ...string) ([]byte, []byte, []byte, error) {
+	salt := make([]byte, saltLenBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// setup encryption cipher
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mode := cipher.NewCBCEncrypter(block, salt)
+
+	// pkcs7 padding the blocksize
+	padded, err := pad(raw, mode.BlockSize())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	value := make([]byte, len(padded))
+	mode.CryptBlocks(value, padded)
+
+	sig, err := macCBC(salt, value, header...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return salt, value, sig, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,84 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// cryptoPAn implements the prefix-preserving address anonymization of
+// Xu, Fan, Ammar and Moon. Two addresses that share a prefix of n bits
+// are anonymized to two addresses that share a prefix of n bits as
+// well. IPv6 addresses are processed like IPv4 addresses, over all
+// 128 bits.
+type cryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// newCryptoPAn returns a cryptoPAn for a 32 byte key. The first half
+// is the AES key, the second half is encrypted to form the pad.
+func newCryptoPAn(key []byte) (*cryptoPAn, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid Crypto-PAn key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// deriveCryptoPAn derives the Crypto-PAn key from the pseudonym key
+// and the data pad
+func deriveCryptoPAn(pseudoKey, dataPad []byte) (*cryptoPAn, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, pseudoKey, dataPad, []byte(`privprod crypto-pan`))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return newCryptoPAn(key)
+}
+
+// anonymize returns the prefix-preserving pseudonym of ip, in the
+// address family of ip
+func (c *cryptoPAn) anonymize(ip net.IP) net.IP {
+	orig := ip.To4()
+	if orig == nil {
+		orig = ip.To16()
+	}
+	var in, out [aes.BlockSize]byte
+	res := make(net.IP, len(orig))
+
+	for pos := 0; pos < len(orig)*8; pos++ {
+		// the first pos bits of the address, followed by the pad
+		in = c.pad
+		copy(in[:pos/8], orig)
+		if r := pos % 8; r > 0 {
+			mask := byte(0xff) << (8 - r)
+			in[pos/8] = orig[pos/8]&mask | c.pad[pos/8]&^mask
+		}
+		c.block.Encrypt(out[:], in[:])
+		res[pos/8] |= (out[0] >> 7) << (7 - pos%8)
+	}
+	for i := range res {
+		res[i] ^= orig[i]
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,117 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// key and sample addresses of the Crypto-PAn reference implementation
+var cryptoPAnKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+func TestCryptoPAnKnownAnswer(t *testing.T) {
+	c, err := newCryptoPAn(cryptoPAnKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ in, out string }{
+		{`128.11.68.132`, `135.242.180.132`},
+		{`129.118.74.4`, `134.136.186.123`},
+		{`130.132.252.244`, `133.68.164.234`},
+		{`141.223.7.43`, `141.167.8.160`},
+		{`141.233.145.108`, `141.129.237.235`},
+		{`156.29.3.236`, `147.225.12.42`},
+		{`165.247.96.84`, `162.9.99.234`},
+		{`166.107.77.190`, `160.132.178.185`},
+		{`192.102.249.13`, `252.138.62.131`},
+		{`192.215.32.125`, `252.43.47.189`},
+		{`192.233.80.103`, `252.25.108.8`},
+		{`192.41.57.43`, `252.222.221.184`},
+		{`193.150.244.223`, `253.169.52.216`},
+		{`195.205.63.100`, `255.186.223.5`},
+		{`198.200.171.101`, `249.199.68.213`},
+		{`198.26.132.101`, `249.36.123.202`},
+		{`198.36.213.5`, `249.7.21.132`},
+		{`198.51.77.238`, `249.18.186.254`},
+		{`199.217.79.101`, `248.38.184.213`},
+	} {
+		// the family of the input must not matter
+		for _, ip := range []net.IP{net.ParseIP(v.in).To4(), net.ParseIP(v.in).To16()} {
+			if got := c.anonymize(ip).String(); got != v.out {
+				t.Errorf("%s: got %s, want %s", v.in, got, v.out)
+			}
+		}
+	}
+}
+
+// The reference implementation has no IPv6 samples. These vectors pin
+// the output of the same algorithm over 128 bits, so that pseudonyms
+// remain stable across releases.
+func TestCryptoPAnIPv6(t *testing.T) {
+	c, err := newCryptoPAn(cryptoPAnKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ in, out string }{
+		{`2001:db8::1`, `4401:2bc:603f:d91d:27f:ff8e:e6f1:dc1e`},
+		{`2001:db8::2`, `4401:2bc:603f:d91d:27f:ff8e:e6f1:dc1c`},
+		{`2001:db8:1::1`, `4401:2bc:603e:23c0:0:6fff:f0f8:c3ed`},
+		{`fe80::1`, `cf7f:c0e:1fc3:da1c:70:b18e:f7f3:2101`},
+		{`::1`, `78ff:f001:9fc0:20df:8380:b1f1:704:ed`},
+	} {
+		if got := c.anonymize(net.ParseIP(v.in)).String(); got != v.out {
+			t.Errorf("%s: got %s, want %s", v.in, got, v.out)
+		}
+	}
+}
+
+// commonBits returns the length of the common prefix of a and b
+func commonBits(a, b net.IP) int {
+	for i := 0; i < len(a)*8; i++ {
+		if bitAt(a, i) != bitAt(b, i) {
+			return i
+		}
+	}
+	return len(a) * 8
+}
+
+func TestCryptoPAnPrefixPreserving(t *testing.T) {
+	c, err := deriveCryptoPAn([]byte(`daily key`), []byte(`data pad`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(42))
+	for _, size := range []int{net.IPv4len, net.IPv6len} {
+		for i := 0; i < 1000; i++ {
+			a := make(net.IP, size)
+			rnd.Read(a)
+			// b shares a random number of leading bits with a
+			b := make(net.IP, size)
+			rnd.Read(b)
+			n := rnd.Intn(size * 8)
+			for j := 0; j < n; j++ {
+				b[j/8] = b[j/8]&^(0x80>>(j%8)) | a[j/8]&(0x80>>(j%8))
+			}
+			pa, pb := c.anonymize(a), c.anonymize(b)
+			if len(pa) != size {
+				t.Fatalf("%s: anonymized to %s of length %d", a, pa, len(pa))
+			}
+			if commonBits(a, b) != commonBits(pa, pb) {
+				t.Fatalf("%s and %s share %d bits, anonymized %s and %s share %d",
+					a, b, commonBits(a, b), pa, pb, commonBits(pa, pb))
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,79 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import "net"
+
+// transition is an IPv6 transition mechanism that embeds an IPv4
+// address into IPv6 addresses of its prefix. IPv4-mapped addresses
+// (::ffff:0:0/96) need no special handling, they are IPv4 addresses
+// to the net package.
+type transition struct {
+	name    string
+	network *net.IPNet
+	// offset is the byte offset of the embedded IPv4 address
+	offset int
+	// inverted is set if the bits of the IPv4 address are inverted
+	inverted bool
+}
+
+// transitions are the well-known transition prefixes
+var transitions = []transition{
+	// RFC 6052 well-known NAT64 prefix
+	{`nat64`, mustCIDR(`64:ff9b::/96`), 12, false},
+	// RFC 3056 6to4
+	{`6to4`, mustCIDR(`2002::/16`), 2, false},
+	// RFC 4380 Teredo, the embedded address is the client address
+	{`teredo`, mustCIDR(`2001::/32`), 12, true},
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// embeddedIPv4 returns the IPv4 address embedded in ip and its
+// transition mechanism, or nil if ip is not within a transition prefix
+func embeddedIPv4(ip net.IP) (net.IP, *transition) {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil, nil
+	}
+	for i := range transitions {
+		t := &transitions[i]
+		if !t.network.Contains(ip) {
+			continue
+		}
+		v4 := make(net.IP, net.IPv4len)
+		copy(v4, ip[t.offset:t.offset+net.IPv4len])
+		if t.inverted {
+			for j := range v4 {
+				v4[j] ^= 0xff
+			}
+		}
+		return v4, t
+	}
+	return nil, nil
+}
+
+// embed returns a copy of ip with v4 as the embedded IPv4 address
+func (t *transition) embed(ip, v4 net.IP) net.IP {
+	res := make(net.IP, net.IPv6len)
+	copy(res, ip)
+	copy(res[t.offset:], v4.To4())
+	if t.inverted {
+		for j := t.offset; j < t.offset+net.IPv4len; j++ {
+			res[j] ^= 0xff
+		}
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,114 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedIPv4(t *testing.T) {
+	m := newNetworkMap()
+	for _, cidr := range []string{`10.0.0.0/8`, `2002:a00:1::/48`} {
+		m.add(&policyEntry{
+			Network: mustCIDR(cidr),
+			Class:   classEmployeePriv,
+			Actions: actPseudonymize | actEncrypt,
+			class:   m.classes[classEmployeePriv],
+		})
+	}
+	m.add(&policyEntry{
+		Network: mustCIDR(`2002:a00:2::/48`),
+		Class:   classInfrastructure,
+		Actions: actPseudonymize | actEncrypt,
+		class:   m.classes[classInfrastructure],
+	})
+
+	for _, c := range []struct {
+		ip, embedded, transition, class string
+	}{
+		{`64:ff9b::a01:203`, `10.1.2.3`, `nat64`, classEmployeePriv},
+		{`2002:a01:203::1`, `10.1.2.3`, `6to4`, classEmployeePriv},
+		// client 10.1.2.3, obfuscated
+		{`2001:0:4136:e378:8000:63bf:f5fe:fdfc`, `10.1.2.3`, `teredo`, classEmployeePriv},
+		// a more specific IPv6 entry takes precedence
+		{`2002:a00:2::1`, `10.0.0.2`, `6to4`, classInfrastructure},
+		{`64:ff9b::808:808`, `8.8.8.8`, `nat64`, classCustomer},
+		{`2001:db8::1`, ``, ``, classCustomer},
+	} {
+		ip := net.ParseIP(c.ip)
+		v4, tr := embeddedIPv4(ip)
+		switch {
+		case c.embedded == `` && v4 != nil:
+			t.Errorf("%s: unexpected embedded address %s", c.ip, v4)
+		case c.embedded != `` && (v4 == nil || v4.String() != c.embedded || tr.name != c.transition):
+			t.Errorf("%s: got %v, want %s (%s)", c.ip, v4, c.embedded, c.transition)
+		}
+		if e := m.lookup(ip); e.Class != c.class {
+			t.Errorf("%s: classified as %s, want %s", c.ip, e.Class, c.class)
+		}
+	}
+}
+
+func TestEmbeddedPseudonym(t *testing.T) {
+	k, _ := newPseudonymKey(`test`, make([]byte, keyLenBytes), time.Time{}, time.Time{})
+	p := &Protector{}
+	for _, c := range []*policyClass{
+		{Name: `ipv4range`, Mode: modeHash, Range4: mustCIDR(`240.0.0.0/8`)},
+		{Name: `hash`, Prefix: `0100:a000`, Mode: modeHash},
+		{Name: `prefix-preserving`, Mode: modePrefixPreserving},
+		{Name: `granularity`, Mode: modePrefixPreserving, Granularity4: 24},
+	} {
+		e := &policyEntry{Actions: actPseudonymize, class: c}
+		var direct string
+		var plen uint8
+		p.protect(&direct, &plen, net.ParseIP(`10.1.2.3`).To16(), e, k)
+		dv4 := net.ParseIP(direct).To4()
+
+		for _, s := range []string{
+			`64:ff9b::a01:203`,
+			`2002:a01:203:1::1`,
+			// client 10.1.2.3, obfuscated
+			`2001:0:4136:e378:8000:63bf:f5fe:fdfc`,
+		} {
+			var addr string
+			var granularity uint8
+			p.protect(&addr, &granularity, net.ParseIP(s), e, k)
+			if granularity != plen {
+				t.Errorf("%s %s: granularity /%d, want /%d", c.Name, s, granularity, plen)
+			}
+			ip := net.ParseIP(addr)
+			if dv4 == nil {
+				// IPv6 pseudonyms of IPv4 addresses are not embedded
+				if addr != direct {
+					t.Errorf("%s %s: pseudonym %s, want %s", c.Name, s, addr, direct)
+				}
+				continue
+			}
+			v4, tr := embeddedIPv4(ip)
+			if v4 == nil || !v4.Equal(dv4) {
+				t.Errorf("%s %s: pseudonym %s does not embed %s", c.Name, s, addr, dv4)
+				continue
+			}
+			if _, want := embeddedIPv4(net.ParseIP(s)); tr != want {
+				t.Errorf("%s %s: embedded into %s, want %s", c.Name, s, tr.name, want.name)
+			}
+			if tr.inverted {
+				for i := range dv4 {
+					if ip[tr.offset+i] != ^dv4[i] {
+						t.Errorf("%s %s: embedded bits of %s not inverted", c.Name, s, addr)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
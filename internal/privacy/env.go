@@ -0,0 +1,77 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envSetting parses the value of the environment variable env
+type envSetting struct {
+	env   string
+	parse func(string) error
+}
+
+// loadEnv parses the settings whose environment variables are set,
+// settings without a value keep their default
+func loadEnv(settings ...envSetting) error {
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != `` {
+			if err := s.parse(v); err != nil {
+				return fmt.Errorf("invalid %s: %s", s.env, v)
+			}
+		}
+	}
+	return nil
+}
+
+// envFloat returns the parse function of a float setting stored in p
+func envFloat(p *float64) func(string) error {
+	return func(s string) (err error) {
+		*p, err = strconv.ParseFloat(s, 64)
+		return
+	}
+}
+
+// envInt returns the parse function of an int setting stored in p
+func envInt(p *int) func(string) error {
+	return func(s string) (err error) {
+		*p, err = strconv.Atoi(s)
+		return
+	}
+}
+
+// envUint returns the parse function of an uint64 setting stored in p
+func envUint(p *uint64) func(string) error {
+	return func(s string) (err error) {
+		*p, err = strconv.ParseUint(s, 10, 64)
+		return
+	}
+}
+
+// envBool returns the parse function of a boolean setting stored in p
+func envBool(p *bool) func(string) error {
+	return func(s string) (err error) {
+		*p, err = strconv.ParseBool(s)
+		return
+	}
+}
+
+// envDuration returns the parse function of a duration setting stored
+// in p
+func envDuration(p *time.Duration) func(string) error {
+	return func(s string) (err error) {
+		*p, err = time.ParseDuration(s)
+		return
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
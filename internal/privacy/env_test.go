@@ -0,0 +1,77 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets the environment variables of env until the end of the
+// test, empty values unset them
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		k := k
+		if prev, ok := os.LookupEnv(k); ok {
+			t.Cleanup(func() { os.Setenv(k, prev) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(k) })
+		}
+		if v == `` {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	setenv(t, map[string]string{
+		`PRIVACY_AGGREGATE_EPSILON`:    `0.5`,
+		`PRIVACY_AGGREGATE_WINDOW`:     `30m`,
+		`PRIVACY_AGGREGATE_MAX_OCTETS`: `1500`,
+		`PRIVACY_AGGREGATE_MAX_FLOWS`:  ``,
+		`PRIVACY_RISK_WINDOW`:          `1h`,
+		`PRIVACY_RISK_PATTERNS`:        `3`,
+	})
+	a, err := newAggregator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.epsilon != 0.5 || a.window != 30*time.Minute || a.maxOctets != 1500 || a.maxFlows != 100 {
+		t.Errorf("aggregates configured with %+v", a)
+	}
+	rt, err := newRiskTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.window != time.Hour || rt.patterns != 3 || rt.interval != 15*time.Minute {
+		t.Errorf("risk report configured with %+v", rt)
+	}
+
+	for env, value := range map[string]string{
+		`PRIVACY_AGGREGATE_MAX_OCTETS`: `-1`,
+		`PRIVACY_AGGREGATE_WINDOW`:     `1`,
+		`PRIVACY_AGGREGATE_DELTA`:      `x`,
+	} {
+		setenv(t, map[string]string{env: value})
+		if _, err := newAggregator(); err == nil || !strings.Contains(err.Error(), `invalid `+env) {
+			t.Errorf("%s=%s: error %v", env, value, err)
+		}
+		setenv(t, map[string]string{env: ``})
+	}
+	setenv(t, map[string]string{`PRIVACY_RISK_LIMIT`: `many`})
+	if _, err := newRiskTracker(); err == nil || !strings.Contains(err.Error(), `invalid PRIVACY_RISK_LIMIT`) {
+		t.Errorf("invalid risk limit: error %v", err)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,301 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+)
+
+// epochStatic is the epoch ID of the legacy PRIVACY_DAILY_KEY
+const epochStatic = `static`
+
+// olderKeysCached is the number of keys of epochs before the two most
+// recent ones that are cached, for replayed or backfilled records
+const olderKeysCached = 16
+
+// pseudonymKey is the pseudonym key of one epoch
+type pseudonymKey struct {
+	id string
+	// start and end of the epoch, zero for the static key
+	start, end time.Time
+	key        []byte
+	// pan is derived from key for prefix-preserving pseudonyms
+	pan *cryptoPAn
+}
+
+// newPseudonymKey returns the pseudonym key of epoch id
+func newPseudonymKey(id string, key []byte, start, end time.Time) (*pseudonymKey, error) {
+	pan, err := deriveCryptoPAn(key, dataPad)
+	if err != nil {
+		return nil, err
+	}
+	return &pseudonymKey{id: id, start: start, end: end, key: key, pan: pan}, nil
+}
+
+// covers reports if t is within the epoch of k
+func (k *pseudonymKey) covers(t time.Time) bool {
+	if k.id == epochStatic {
+		return true
+	}
+	return !t.Before(k.start) && t.Before(k.end)
+}
+
+// keySchedule provides the pseudonym keys of all epochs. Epochs of
+// length start at midnight UTC shifted by offset, keys are derived
+// from master or read from path.
+type keySchedule struct {
+	master []byte
+	path   string
+	static *pseudonymKey
+	length time.Duration
+	offset time.Duration
+	// recent holds a []*pseudonymKey of the keys last used, the
+	// newest first, which is shared by all handlers
+	recent atomic.Value
+	// older caches the keys of older epochs, guarded by lock
+	older *keyCache
+	lock  sync.Mutex
+}
+
+// keyCache holds the least recently used pseudonym keys by epoch ID
+type keyCache struct {
+	size int
+	// order lists the keys, the most recently used first
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{size: size, order: list.New(), keys: map[string]*list.Element{}}
+}
+
+// get returns the cached key of epoch id, or nil
+func (c *keyCache) get(id string) *pseudonymKey {
+	el, ok := c.keys[id]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*pseudonymKey)
+}
+
+// add caches key k, dropping the least recently used key if the cache
+// is full
+func (c *keyCache) add(k *pseudonymKey) {
+	if _, ok := c.keys[k.id]; ok {
+		return
+	}
+	c.keys[k.id] = c.order.PushFront(k)
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.keys, last.Value.(*pseudonymKey).id)
+	}
+}
+
+// pseudoKeys is the key schedule of all handlers, nil if no pseudonym
+// key is configured
+var pseudoKeys *keySchedule
+
+// LoadPseudonymKeys configures the pseudonym key schedule from the
+// environment. It must be called successfully once before the first
+// Protector is started.
+func LoadPseudonymKeys() error {
+	s, err := keyScheduleFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// the key of the current epoch must be available at startup
+	k, err := s.current()
+	if err != nil {
+		return err
+	}
+	if linkage, err = newLinkageTracker(); err != nil {
+		return err
+	}
+	pseudoKeys = s
+	logrus.Infof("Privacy: using pseudonym key of epoch %s\n", k.id)
+	return nil
+}
+
+// keyScheduleFromEnv returns the pseudonym key schedule configured by
+// the environment
+func keyScheduleFromEnv() (*keySchedule, error) {
+	s := &keySchedule{length: 24 * time.Hour}
+	var err error
+	if v := os.Getenv(`PRIVACY_PSEUDONYM_EPOCH`); v != `` {
+		if s.length, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid PRIVACY_PSEUDONYM_EPOCH: %s", err.Error())
+		}
+	}
+	if v := os.Getenv(`PRIVACY_PSEUDONYM_EPOCH_OFFSET`); v != `` {
+		if s.offset, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid PRIVACY_PSEUDONYM_EPOCH_OFFSET: %s", err.Error())
+		}
+	}
+	if s.length < time.Minute || s.offset < 0 || s.offset >= s.length ||
+		(24*time.Hour%s.length != 0 && s.length%(24*time.Hour) != 0) {
+		return nil, fmt.Errorf("invalid pseudonym epoch %s with offset %s", s.length, s.offset)
+	}
+
+	master := os.Getenv(`PRIVACY_PSEUDONYM_MASTER_KEY`)
+	s.path = os.Getenv(`PRIVACY_PSEUDONYM_KEY_PATH`)
+	legacy := os.Getenv(`PRIVACY_DAILY_KEY`)
+	switch {
+	case master != `` && s.path != ``:
+		return nil, fmt.Errorf("PRIVACY_PSEUDONYM_MASTER_KEY and PRIVACY_PSEUDONYM_KEY_PATH are exclusive")
+	case master != ``:
+		if s.master, err = decodeKey(master); err != nil {
+			return nil, fmt.Errorf("invalid PRIVACY_PSEUDONYM_MASTER_KEY: %s", err.Error())
+		}
+	case s.path != ``:
+	case legacy != ``:
+		key, err := hex.DecodeString(legacy)
+		if err != nil || len(key) == 0 || len(key) > 64 {
+			return nil, fmt.Errorf("invalid PRIVACY_DAILY_KEY")
+		}
+		if s.static, err = newPseudonymKey(epochStatic, key, time.Time{}, time.Time{}); err != nil {
+			return nil, err
+		}
+		logrus.Warnln(`Privacy: PRIVACY_DAILY_KEY is deprecated, pseudonym keys are not rotated`)
+	default:
+		return nil, fmt.Errorf("no pseudonym key configured")
+	}
+	return s, nil
+}
+
+// decodeKey decodes a hex encoded key of keyLenBytes
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLenBytes {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// keyTime returns the time that selects the pseudonym key of record r,
+// its start time
+func keyTime(r *flowdata.Record) time.Time {
+	if r.StartMilli.IsZero() {
+		return time.Now()
+	}
+	return r.StartMilli
+}
+
+// epoch returns the ID, start and end of the epoch of t
+func (s *keySchedule) epoch(t time.Time) (string, time.Time, time.Time) {
+	start := t.UTC().Add(-s.offset).Truncate(s.length).Add(s.offset)
+	if s.length%(24*time.Hour) == 0 && s.offset == 0 {
+		return start.Format(`2006-01-02`), start, start.Add(s.length)
+	}
+	return start.Format(`2006-01-02T15:04Z`), start, start.Add(s.length)
+}
+
+// current returns the pseudonym key of the current epoch
+func (s *keySchedule) current() (*pseudonymKey, error) {
+	return s.at(time.Now())
+}
+
+// at returns the pseudonym key of the epoch of t. Keys are derived or
+// read once, and switched for all handlers at the same time.
+func (s *keySchedule) at(t time.Time) (*pseudonymKey, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no pseudonym key configured")
+	}
+	if s.static != nil {
+		return s.static, nil
+	}
+	if k := s.cached(t); k != nil {
+		return k, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if k := s.cached(t); k != nil {
+		return k, nil
+	}
+	if s.older == nil {
+		s.older = newKeyCache(olderKeysCached)
+	}
+	id, _, _ := s.epoch(t)
+	if k := s.older.get(id); k != nil {
+		return k, nil
+	}
+	k, err := s.load(t)
+	if err != nil {
+		return nil, err
+	}
+	// keep the two most recent epochs, records around the start of an
+	// epoch use both
+	recent, _ := s.recent.Load().([]*pseudonymKey)
+	switch {
+	case len(recent) == 0:
+		recent = []*pseudonymKey{k}
+	case k.start.After(recent[0].start):
+		recent = []*pseudonymKey{k, recent[0]}
+		logrus.Infof("Privacy: rotated pseudonym key to epoch %s\n", k.id)
+	default:
+		s.older.add(k)
+		return k, nil
+	}
+	s.recent.Store(recent)
+	return k, nil
+}
+
+// cached returns the cached key of the epoch of t, or nil
+func (s *keySchedule) cached(t time.Time) *pseudonymKey {
+	recent, _ := s.recent.Load().([]*pseudonymKey)
+	for _, k := range recent {
+		if k.covers(t) {
+			return k
+		}
+	}
+	return nil
+}
+
+// load derives or reads the key of the epoch of t
+func (s *keySchedule) load(t time.Time) (*pseudonymKey, error) {
+	id, start, end := s.epoch(t)
+	key := make([]byte, keyLenBytes)
+	if s.master != nil {
+		kdf := hkdf.New(sha256.New, s.master, dataPad, []byte(`privprod pseudonym key `+id))
+		if _, err := io.ReadFull(kdf, key); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := ioutil.ReadFile(filepath.Join(s.path, id+`.key`))
+		if err != nil {
+			return nil, fmt.Errorf("no pseudonym key for epoch %s: %s", id, err.Error())
+		}
+		if key, err = decodeKey(string(data)); err != nil {
+			return nil, fmt.Errorf("invalid pseudonym key for epoch %s: %s", id, err.Error())
+		}
+	}
+	return newPseudonymKey(id, key, start, end)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,158 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyScheduleEpochs(t *testing.T) {
+	for _, c := range []struct {
+		length, offset time.Duration
+		at, id         string
+	}{
+		{24 * time.Hour, 0, `2021-07-14T23:59:59Z`, `2021-07-14`},
+		{24 * time.Hour, 0, `2021-07-15T00:00:00Z`, `2021-07-15`},
+		{24 * time.Hour, 0, `2021-07-15T01:00:00+02:00`, `2021-07-14`},
+		{24 * time.Hour, 6 * time.Hour, `2021-07-15T05:00:00Z`, `2021-07-14T06:00Z`},
+		{6 * time.Hour, 0, `2021-07-15T13:00:00Z`, `2021-07-15T12:00Z`},
+	} {
+		s := &keySchedule{length: c.length, offset: c.offset}
+		ts, _ := time.Parse(time.RFC3339, c.at)
+		id, start, end := s.epoch(ts)
+		if id != c.id {
+			t.Errorf("%s: epoch %s, want %s", c.at, id, c.id)
+		}
+		if ts.Before(start) || !ts.Before(end) {
+			t.Errorf("%s: not within epoch %s to %s", c.at, start, end)
+		}
+	}
+}
+
+func TestKeyScheduleLength(t *testing.T) {
+	setenv(t, map[string]string{`PRIVACY_PSEUDONYM_MASTER_KEY`: strings.Repeat(`ab`, keyLenBytes)})
+	for _, c := range []struct {
+		length, offset string
+		ok             bool
+	}{
+		{``, ``, true},
+		{`6h`, `1h`, true},
+		{`90m`, ``, true},
+		{`168h`, `24h`, true},
+		{`7h`, ``, false},
+		{`36h`, ``, false},
+		{`24h`, `24h`, false},
+		{`30s`, ``, false},
+	} {
+		setenv(t, map[string]string{
+			`PRIVACY_PSEUDONYM_EPOCH`:        c.length,
+			`PRIVACY_PSEUDONYM_EPOCH_OFFSET`: c.offset,
+		})
+		if _, err := keyScheduleFromEnv(); (err == nil) != c.ok {
+			t.Errorf("epoch %q with offset %q: error %v", c.length, c.offset, err)
+		}
+	}
+}
+
+func TestKeyScheduleRotation(t *testing.T) {
+	s := &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	day1, _ := time.Parse(time.RFC3339, `2021-07-14T12:00:00Z`)
+	day2 := day1.Add(24 * time.Hour)
+
+	k1, err := s.at(day1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := s.at(day2)
+	if k1.id == k2.id || string(k1.key) == string(k2.key) {
+		t.Errorf("epochs %s and %s share a key", k1.id, k2.id)
+	}
+	if k, _ := s.at(day1.Add(time.Hour)); k != k1 {
+		t.Errorf("key of epoch %s not reused", k1.id)
+	}
+
+	c := &policyClass{Name: `test`, Prefix: `0100:c000`, Mode: modeHash}
+	ip := net.ParseIP(`192.0.2.1`).To16()
+	p1, _ := pseudonymize(ip, c, k1)
+	p2, _ := pseudonymize(ip, c, k2)
+	if p1 == p2 {
+		t.Errorf("pseudonym %s linkable across epochs", p1)
+	}
+
+	// keys read from the key path are only available for their epoch
+	dir, err := ioutil.TempDir(``, `privprod`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := strings.Repeat(`ab`, keyLenBytes) + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, `2021-07-14.key`), []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = &keySchedule{length: 24 * time.Hour, path: dir}
+	if _, err := s.at(day1); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.at(day2); err == nil {
+		t.Errorf("key of epoch 2021-07-15 available without key file")
+	}
+}
+
+func TestKeyScheduleOlderEpochs(t *testing.T) {
+	dir := writeTestFiles(t, nil)
+	now, _ := time.Parse(time.RFC3339, `2021-07-30T12:00:00Z`)
+	day := func(i int) time.Time {
+		return now.Add(-time.Duration(i) * 24 * time.Hour)
+	}
+	s := &keySchedule{length: 24 * time.Hour, path: dir}
+	for i := 0; i <= olderKeysCached+2; i++ {
+		id, _, _ := s.epoch(day(i))
+		key := strings.Repeat(`ab`, keyLenBytes)
+		if err := ioutil.WriteFile(filepath.Join(dir, id+`.key`), []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.at(now); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed records of an older epoch read its key once
+	old, err := s.at(day(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, old.id+`.key`)); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := s.at(day(5).Add(time.Hour)); err != nil || k != old {
+		t.Errorf("key of epoch %s not cached: %v", old.id, err)
+	}
+
+	// the least recently used key is dropped
+	for i := 2; i <= olderKeysCached+2; i++ {
+		if i != 5 {
+			if _, err := s.at(day(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := s.at(day(5)); err == nil {
+		t.Errorf("key of epoch %s still cached", old.id)
+	}
+	if _, err := s.at(day(olderKeysCached + 2)); err != nil {
+		t.Errorf("recently used key dropped: %v", err)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,186 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+// Explanation describes how the active network maps classify an
+// address and what process would do with it
+type Explanation struct {
+	Address string
+	AgentID string
+	Time    time.Time
+	// Scope is the network map scope of the exporter, empty for the
+	// global network map
+	Scope string
+	// Version is the ID of the network map version effective at Time
+	Version string
+	// Site, IngressName, IngressZone, EgressName and EgressZone
+	// are taken from the inventory
+	Site        string
+	IngressName string
+	IngressZone string
+	EgressName  string
+	EgressZone  string
+	// Embedded is the IPv4 address embedded in the address and
+	// Transition its transition mechanism, if any
+	Embedded   string
+	Transition string
+	// Matches are all policy entries containing the address, and
+	// the embedded address, from the least to the most specific
+	// network, followed by the matching interface rule without a
+	// network
+	Matches []ExplainedEntry
+	// Winner is the entry that applies to the address
+	Winner ExplainedEntry
+	// Default is set if no entry matched and the policy default
+	// applies
+	Default      bool
+	Discard      bool
+	Pseudonymize bool
+	Encrypt      bool
+	Pass         bool
+	// IOC is the record published to the IOC topic, if any
+	IOC *flowdata.IOC
+	// Pseudonym is the pseudonym of the address, if it is
+	// pseudonymized and the pseudonym key is available
+	Pseudonym string
+	// Generalization describes how the class of the address
+	// generalizes published records
+	Generalization string
+	// Epoch is the pseudonym key epoch of Time, KeyError is set if
+	// its key is not available
+	Epoch    string
+	KeyError string
+	// Granularity is the prefix length the pseudonym applies to
+	Granularity int
+}
+
+// ExplainedEntry is an exported view of a policy entry
+type ExplainedEntry struct {
+	Network  string
+	Class    string
+	Labels   []string
+	Actions  string
+	Priority int
+	Scope    string
+	Source   string
+}
+
+func explainEntry(e *policyEntry) ExplainedEntry {
+	x := ExplainedEntry{
+		Class:    e.Class,
+		Labels:   e.Labels,
+		Actions:  e.Actions.String(),
+		Priority: e.Priority,
+		Scope:    e.Scope,
+		Source:   e.Source,
+	}
+	if e.Network != nil {
+		x.Network = e.Network.String()
+	}
+	return x
+}
+
+// Explain classifies address addr as seen by exporter agentID at time t
+// with the active network maps
+func Explain(addr, agentID string, t time.Time) (*Explanation, error) {
+	return ExplainFlow(addr, false, flowdata.Record{
+		AgentID:    agentID,
+		StartMilli: t,
+		EndMilli:   t,
+	})
+}
+
+// ExplainFlow classifies address addr as the source address of record
+// r, or as its destination address if dst is set, with the active
+// network maps. The interfaces, flow direction, exporter and start
+// time are taken from r.
+func ExplainFlow(addr string, dst bool, r flowdata.Record) (*Explanation, error) {
+	ip := net.ParseIP(addr).To16()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", addr)
+	}
+	store := networkMaps()
+	if store == nil {
+		return nil, fmt.Errorf("no network maps loaded")
+	}
+	networks := store.at(r.StartMilli).forAgent(r.AgentID)
+	r.MapVersion = networks.version
+	networks.inventory.enrich(&r)
+
+	x := &Explanation{
+		Address: ip.String(),
+		AgentID: r.AgentID,
+		Time:    r.StartMilli,
+		Scope:   networks.scope,
+		Version: networks.version,
+		Matches: []ExplainedEntry{},
+
+		Site:        r.Site,
+		IngressName: r.IngressName,
+		IngressZone: r.IngressZone,
+		EgressName:  r.EgressName,
+		EgressZone:  r.EgressZone,
+	}
+	for _, e := range networks.trie.Matches(ip) {
+		x.Matches = append(x.Matches, explainEntry(e))
+	}
+	if v4, tr := embeddedIPv4(ip); v4 != nil {
+		x.Embedded, x.Transition = v4.String(), tr.name
+		for _, e := range networks.trie.Matches(v4) {
+			x.Matches = append(x.Matches, explainEntry(e))
+		}
+	}
+
+	e := networks.lookup(ip)
+	x.Default = e == networks.fallback
+	if rule := networks.ruleFor(&r, dst); rule != nil {
+		x.Matches = append(x.Matches, explainEntry(rule))
+		if rule.Priority >= e.Priority {
+			e, x.Default = rule, false
+		}
+	}
+	x.Winner = explainEntry(e)
+	x.Discard = e.Actions.has(actDiscard)
+	x.Pseudonymize = e.Actions.has(actPseudonymize)
+	x.Encrypt = e.Actions.has(actEncrypt)
+	x.Pass = e.Actions.has(actPass)
+	if e.class != nil {
+		x.Generalization = e.class.Generalize.String()
+	}
+
+	if e.Actions.has(actIOC) {
+		r.IPVersion = 6
+		if ip.To4() != nil {
+			r.IPVersion = 4
+		}
+		ioc := r.ToIOC(ip.String())
+		x.IOC = &ioc
+	}
+
+	if x.Pseudonymize {
+		key, err := pseudoKeys.at(keyTime(&r))
+		if err != nil {
+			x.KeyError = err.Error()
+			return x, nil
+		}
+		x.Epoch = key.id
+		x.Pseudonym, x.Granularity = pseudonymize(ip, e.class, key)
+		x.Pseudonym = formatAddress(x.Pseudonym)
+	}
+	return x, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,111 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestExplainFlow(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{
+	  "networks": [
+	    {"prefix": "10.0.0.0/8", "class": "infrastructure", "labels": ["dc"]},
+	    {"prefix": "10.1.0.0/16", "class": "employee-private", "labels": ["office"]},
+	    {"prefix": "10.1.2.0/24", "class": "discard", "priority": -5}
+	  ],
+	  "interfaces": [
+	    {"ingress": 12, "address": "src", "class": "partner", "labels": ["vpn"]}
+	  ]
+	}`})
+	if prev := activeNetworks.Load(); prev != nil {
+		defer activeNetworks.Store(prev)
+	}
+	if err := LoadNetworkMaps(NetworkConfig{PolicyFile: filepath.Join(dir, `policy.json`)}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *keySchedule) { pseudoKeys = s }(pseudoKeys)
+	pseudoKeys = &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	now := time.Date(2021, 7, 14, 10, 30, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		addr     string
+		ingress  uint32
+		matches  []string
+		network  string
+		class    string
+		actions  string
+		embedded string
+		ioc      bool
+	}{
+		{addr: `10.1.2.3`, matches: []string{`10.0.0.0/8`, `10.1.0.0/16`, `10.1.2.0/24`},
+			network: `10.1.0.0/16`, class: classEmployeePriv, actions: `pseudonymize,encrypt`},
+		{addr: `64:ff9b::a01:203`, matches: []string{`10.0.0.0/8`, `10.1.0.0/16`, `10.1.2.0/24`},
+			network: `10.1.0.0/16`, class: classEmployeePriv, actions: `pseudonymize,encrypt`,
+			embedded: `10.1.2.3`},
+		{addr: `8.8.8.8`, matches: []string{},
+			class: classCustomer, actions: `pseudonymize,encrypt,ioc`, ioc: true},
+		{addr: `127.0.0.1`, matches: []string{`127.0.0.0/8`},
+			network: `127.0.0.0/8`, class: classSpecialPurpose, actions: `pass`},
+		// the interface rule is listed last, without a network
+		{addr: `10.9.9.9`, ingress: 12, matches: []string{`10.0.0.0/8`, ``},
+			class: classPartner, actions: `pseudonymize,encrypt`},
+	} {
+		x, err := ExplainFlow(c.addr, false, flowdata.Record{StartMilli: now, IngressIf: c.ingress})
+		if err != nil {
+			t.Fatalf("%s: %s", c.addr, err)
+		}
+		networks := []string{}
+		for _, m := range x.Matches {
+			networks = append(networks, m.Network)
+		}
+		if strings.Join(networks, ` `) != strings.Join(c.matches, ` `) {
+			t.Errorf("%s: matches %q, want %q", c.addr, networks, c.matches)
+		}
+		if x.Winner.Network != c.network || x.Winner.Class != c.class || x.Winner.Actions != c.actions {
+			t.Errorf("%s: applied %s %s [%s], want %s %s [%s]", c.addr, x.Winner.Network,
+				x.Winner.Class, x.Winner.Actions, c.network, c.class, c.actions)
+		}
+		if x.Default != (c.network == `` && c.ingress == 0) {
+			t.Errorf("%s: default %t", c.addr, x.Default)
+		}
+		if x.Embedded != c.embedded {
+			t.Errorf("%s: embedded address %s, want %s", c.addr, x.Embedded, c.embedded)
+		}
+		if (x.IOC != nil) != c.ioc {
+			t.Errorf("%s: IOC %t, want %t", c.addr, x.IOC != nil, c.ioc)
+		}
+		if x.Pseudonymize != strings.Contains(c.actions, `pseudonymize`) ||
+			x.Pass != (c.actions == `pass`) || x.Discard {
+			t.Errorf("%s: unexpected actions %+v", c.addr, x)
+		}
+		if x.Pseudonymize && (x.Pseudonym == `` || x.Pseudonym == x.Address || x.Epoch == ``) {
+			t.Errorf("%s: pseudonym %q of epoch %q", c.addr, x.Pseudonym, x.Epoch)
+		}
+	}
+
+	// without a pseudonym key the classification is still explained
+	pseudoKeys = nil
+	x, err := Explain(`10.1.2.3`, ``, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Winner.Class != classEmployeePriv || x.Pseudonym != `` || x.KeyError == `` {
+		t.Errorf("explained without key as %s, pseudonym %q, key error %q",
+			x.Winner.Class, x.Pseudonym, x.KeyError)
+	}
+	if _, err := Explain(`10.1.2`, ``, now); err == nil {
+		t.Errorf("invalid address explained")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
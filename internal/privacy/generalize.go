@@ -0,0 +1,147 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+// defaultPortsFrom is the first port that is generalized, unless the
+// class configures another one
+const defaultPortsFrom = 1024
+
+// maxTimeGranularity is the longest time granularity, records carry it
+// in milliseconds as uint32
+const maxTimeGranularity = math.MaxUint32 * time.Millisecond
+
+// generalization coarsens the quasi-identifiers of the published
+// records of a class. The zero value keeps all values.
+type generalization struct {
+	// Time is the granularity timestamps are truncated to
+	Time time.Duration
+	// Ports from PortsFrom onwards are replaced by the first port of
+	// their bucket of PortBucket ports
+	PortsFrom  uint16
+	PortBucket uint16
+	// Counts rounds octet and packet counts down to powers of two
+	Counts bool
+}
+
+// policyFileGeneralization is the JSON representation of a
+// generalization
+type policyFileGeneralization struct {
+	Time  string `json:"time,omitempty"`
+	Ports *struct {
+		From   uint16 `json:"from,omitempty"`
+		Bucket uint16 `json:"bucket"`
+	} `json:"ports,omitempty"`
+	Counts bool `json:"counts,omitempty"`
+}
+
+// parse converts the file representation into a generalization
+func (pfg *policyFileGeneralization) parse() (generalization, error) {
+	g := generalization{Counts: pfg.Counts}
+	if pfg.Time != `` {
+		d, err := time.ParseDuration(pfg.Time)
+		switch {
+		case err != nil || d < time.Millisecond || d%time.Millisecond != 0:
+			return g, fmt.Errorf("invalid time granularity %s", pfg.Time)
+		case d > maxTimeGranularity:
+			return g, fmt.Errorf("time granularity %s exceeds %s", pfg.Time, maxTimeGranularity)
+		}
+		g.Time = d
+	}
+	if p := pfg.Ports; p != nil {
+		if p.Bucket < 2 {
+			return g, fmt.Errorf("invalid port bucket %d", p.Bucket)
+		}
+		g.PortsFrom, g.PortBucket = p.From, p.Bucket
+		if g.PortsFrom == 0 {
+			g.PortsFrom = defaultPortsFrom
+		}
+	}
+	return g, nil
+}
+
+// String describes the generalization
+func (g generalization) String() string {
+	parts := []string{}
+	if g.Time > 0 {
+		parts = append(parts, fmt.Sprintf("time %s", g.Time))
+	}
+	if g.PortBucket > 0 {
+		parts = append(parts, fmt.Sprintf("ports from %d in buckets of %d",
+			g.PortsFrom, g.PortBucket))
+	}
+	if g.Counts {
+		parts = append(parts, `counts`)
+	}
+	if len(parts) == 0 {
+		return `none`
+	}
+	return strings.Join(parts, `, `)
+}
+
+// port returns the generalized port p and the size of its bucket, zero
+// if p is kept
+func (g generalization) port(p uint16) (uint16, uint16) {
+	if g.PortBucket == 0 || p < g.PortsFrom {
+		return p, 0
+	}
+	start := uint32(g.PortsFrom) + (uint32(p-g.PortsFrom)/uint32(g.PortBucket))*uint32(g.PortBucket)
+	return uint16(start), g.PortBucket
+}
+
+// generalizeRecord applies the generalizations of the classes src and
+// dst of the source and destination address to record r. Ports follow
+// the class of their address, timestamps and counts the stricter
+// class.
+func generalizeRecord(r *flowdata.Record, src, dst *policyClass) {
+	var gs, gd generalization
+	if src != nil {
+		gs = src.Generalize
+	}
+	if dst != nil {
+		gd = dst.Generalize
+	}
+
+	r.SrcPort, r.SrcPortBucket = gs.port(r.SrcPort)
+	r.DstPort, r.DstPortBucket = gd.port(r.DstPort)
+
+	d := gs.Time
+	if gd.Time > d {
+		d = gd.Time
+	}
+	if d > 0 {
+		r.StartMilli = r.StartMilli.Truncate(d)
+		r.EndMilli = r.EndMilli.Truncate(d)
+		r.TimeBucket = uint32(d / time.Millisecond)
+	}
+
+	if gs.Counts || gd.Counts {
+		r.OctetCount = bucketCount(r.OctetCount)
+		r.PacketCount = bucketCount(r.PacketCount)
+		r.CountsBucketed = true
+	}
+}
+
+// bucketCount rounds v down to a power of two
+func bucketCount(v uint64) uint64 {
+	if v == 0 {
+		return 0
+	}
+	return 1 << (bits.Len64(v) - 1)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
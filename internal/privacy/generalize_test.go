@@ -0,0 +1,74 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestGeneralizeRecord(t *testing.T) {
+	classes := builtinClasses()
+	pfc := policyFileClass{Name: classEmployeePriv}
+	if err := json.Unmarshal([]byte(`{"time": "1m", "ports": {"bucket": 1024}, "counts": true}`),
+		&pfc.Generalize); err != nil {
+		t.Fatal(err)
+	}
+	if err := pfc.define(classes, `test`); err != nil {
+		t.Fatal(err)
+	}
+
+	start, _ := time.Parse(time.RFC3339Nano, `2021-07-14T12:34:56.789Z`)
+	r := flowdata.Record{
+		SrcPort:     51234,
+		DstPort:     443,
+		StartMilli:  start,
+		EndMilli:    start.Add(90 * time.Second),
+		OctetCount:  1500,
+		PacketCount: 3,
+	}
+	original := r.Copy()
+	generalizeRecord(&r, classes[classEmployeePriv], classes[classCustomer])
+
+	switch {
+	case r.SrcPort != 51200 || r.SrcPortBucket != 1024:
+		t.Errorf("source port %d in bucket %d, want 51200 in 1024", r.SrcPort, r.SrcPortBucket)
+	case r.DstPort != 443 || r.DstPortBucket != 0:
+		t.Errorf("destination port of an ungeneralized class changed to %d", r.DstPort)
+	case r.StartMilli.Format(time.RFC3339Nano) != `2021-07-14T12:34:00Z`,
+		r.EndMilli.Format(time.RFC3339Nano) != `2021-07-14T12:36:00Z`,
+		r.TimeBucket != 60000:
+		t.Errorf("timestamps %s to %s not truncated to 1m", r.StartMilli, r.EndMilli)
+	case r.OctetCount != 1024 || r.PacketCount != 2 || !r.CountsBucketed:
+		t.Errorf("counts %d/%d not bucketed", r.OctetCount, r.PacketCount)
+	}
+
+	p := original.ExportPlaintext()
+	if p.SrcPort != 51234 || !p.StartMilli.Equal(start) || p.OctetCount != 1500 {
+		t.Errorf("encrypted original lost the exact values")
+	}
+
+	for _, d := range []string{`1ns`, `999us`, `1500us`, `1193h2m47.296s`, `2000h`, `-1m`} {
+		pfc = policyFileClass{Name: `x`, Actions: []string{`pass`},
+			Generalize: &policyFileGeneralization{Time: d}}
+		if err := pfc.define(classes, `test`); err == nil {
+			t.Errorf("accepted time granularity %s", d)
+		}
+	}
+	// the longest granularity that fits TimeBucketMilli
+	pfg := policyFileGeneralization{Time: `1193h2m47.295s`}
+	if g, err := pfg.parse(); err != nil || uint32(g.Time/time.Millisecond) != math.MaxUint32 {
+		t.Errorf("time granularity %s: %v", g.Time, err)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -8,7 +8,7 @@
 package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
 
 import (
-	"net"
+	"sync/atomic"
 
 	"github.com/mjolnir42/erebos"
 )
@@ -19,12 +19,18 @@ var Handlers map[int]erebos.Handler
 
 //
 var (
-	dataPad, pseudoKey   []byte
-	employeePrivNetworks map[string]*net.IPNet
-	employeePubNetworks  map[string]*net.IPNet
-	companyPubNetworks   map[string]*net.IPNet
-	reservedPrivNetworks map[string]*net.IPNet
-	discardNetworks      map[string]*net.IPNet
+	dataPad []byte
+	// addressFormat is the format of the addresses within published
+	// records, formatFull or formatNative
+	addressFormat = formatFull
+	// recordLabels adds the class and labels of both addresses to
+	// published records, if PRIVACY_RECORD_LABELS is set to true
+	recordLabels = false
+	// generalizeUnencrypted generalizes records without an encrypted
+	// original, if PRIVACY_GENERALIZE_UNENCRYPTED is set to true
+	generalizeUnencrypted = false
+	// activeNetworks holds the *networkStore used by all handlers
+	activeNetworks atomic.Value
 )
 
 //
@@ -33,4 +39,14 @@ const (
 	saltLenBytes = 16
 )
 
+// Address formats of published records
+const (
+	// formatFull writes all addresses as fully expanded IPv6
+	// addresses
+	formatFull = `full`
+	// formatNative writes addresses in their address family as
+	// specified by RFC 5952
+	formatNative = `native`
+)
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
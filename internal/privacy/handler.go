@@ -14,6 +14,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 
 	"github.com/mjolnir42/erebos"
 	"github.com/mjolnir42/privprod/internal/flowdata"
@@ -26,10 +27,35 @@ func init() {
 
 	// BUG: datapad should be read from Zookeeper
 	dataPad, _ = hex.DecodeString(os.Getenv(`PRIVACY_DATAPAD`))
-	// TODO: daily rotate pseudokey
-	pseudoKey, _ = hex.DecodeString(os.Getenv(`PRIVACY_DAILY_KEY`))
 
-	buildNetworkMaps()
+	switch f := os.Getenv(`PRIVACY_ADDRESS_FORMAT`); f {
+	case ``:
+	case formatFull, formatNative:
+		addressFormat = f
+	default:
+		logrus.Warnf("Privacy: unknown PRIVACY_ADDRESS_FORMAT %s, using %s\n",
+			f, formatFull)
+	}
+
+	if v := os.Getenv(`PRIVACY_RECORD_LABELS`); v != `` {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			logrus.Warnf("Privacy: invalid PRIVACY_RECORD_LABELS %s, using %t\n",
+				v, recordLabels)
+		} else {
+			recordLabels = b
+		}
+	}
+
+	if v := os.Getenv(`PRIVACY_GENERALIZE_UNENCRYPTED`); v != `` {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			logrus.Warnf("Privacy: invalid PRIVACY_GENERALIZE_UNENCRYPTED %s, using %t\n",
+				v, generalizeUnencrypted)
+		} else {
+			generalizeUnencrypted = b
+		}
+	}
 }
 
 // Dispatch implements erebos.Dispatcher
@@ -0,0 +1,206 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE ciphersuite identifiers of RFC 9180, session keys are wrapped
+// in base mode
+const (
+	// hpkeKEM is DHKEM(X25519, HKDF-SHA256)
+	hpkeKEM = 0x0020
+	// hpkeKDF is HKDF-SHA256
+	hpkeKDF = 0x0001
+	// hpkeAEAD is ChaCha20Poly1305
+	hpkeAEAD = 0x0003
+	// hpkeModeBase is the mode without PSK and sender authentication
+	hpkeModeBase = 0x00
+)
+
+// hpkeSuite returns the suite_id of the KEM, or of the full
+// ciphersuite if kem is false
+func hpkeSuite(kem bool) []byte {
+	if kem {
+		return append([]byte(`KEM`), i2osp(hpkeKEM, 2)...)
+	}
+	suite := []byte(`HPKE`)
+	suite = append(suite, i2osp(hpkeKEM, 2)...)
+	suite = append(suite, i2osp(hpkeKDF, 2)...)
+	return append(suite, i2osp(hpkeAEAD, 2)...)
+}
+
+// i2osp returns n as big endian integer of length l
+func i2osp(n, l int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	return b[8-l:]
+}
+
+// labeledExtract is LabeledExtract of RFC 9180
+func labeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	labeled := bytes.Join([][]byte{[]byte(`HPKE-v1`), suite, []byte(label), ikm}, nil)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+// labeledExpand is LabeledExpand of RFC 9180
+func labeledExpand(suite, prk []byte, label string, info []byte, l int) ([]byte, error) {
+	labeled := bytes.Join([][]byte{i2osp(l, 2), []byte(`HPKE-v1`), suite, []byte(label), info}, nil)
+	out := make([]byte, l)
+	if _, err := hkdf.Expand(sha256.New, prk, labeled).Read(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// hpkeSharedSecret is ExtractAndExpand of DHKEM
+func hpkeSharedSecret(dh, enc, pkR []byte) ([]byte, error) {
+	suite := hpkeSuite(true)
+	prk := labeledExtract(suite, nil, `eae_prk`, dh)
+	return labeledExpand(suite, prk, `shared_secret`, append(append([]byte{}, enc...), pkR...), 32)
+}
+
+// hpkeContext returns the key and base nonce of the base mode key
+// schedule
+func hpkeContext(secret, info []byte) ([]byte, []byte, error) {
+	suite := hpkeSuite(false)
+	ctx := []byte{hpkeModeBase}
+	ctx = append(ctx, labeledExtract(suite, nil, `psk_id_hash`, nil)...)
+	ctx = append(ctx, labeledExtract(suite, nil, `info_hash`, info)...)
+	prk := labeledExtract(suite, secret, `secret`, nil)
+
+	key, err := labeledExpand(suite, prk, `key`, ctx, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := labeledExpand(suite, prk, `base_nonce`, ctx, chacha20poly1305.NonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, nonce, nil
+}
+
+// hpkeSeal encrypts pt to the recipient public key pkR, with the
+// ephemeral private key skE. It returns the encapsulated key and the
+// ciphertext.
+func hpkeSeal(pkR, skE, info, aad, pt []byte) ([]byte, []byte, error) {
+	enc, err := curve25519.X25519(skE, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := hpkeSharedSecret(dh, enc, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, nonce, err := hpkeContext(secret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, aead.Seal(nil, nonce, pt, aad), nil
+}
+
+// hpkeOpen decrypts ct of hpkeSeal with the recipient private key skR
+func hpkeOpen(skR, enc, info, aad, ct []byte) ([]byte, error) {
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(skR, enc)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hpkeSharedSecret(dh, enc, pkR)
+	if err != nil {
+		return nil, err
+	}
+	key, nonce, err := hpkeContext(secret, info)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return pt, nil
+}
+
+// wrapKey encrypts the symmetric key value with ID id for each of the
+// unlock keys and returns the key record
+func wrapKey(unlockKeys []crypto.PublicKey, id string, value []byte) (*flowdata.Key, error) {
+	key := &flowdata.Key{ID: id, Version: flowdata.KeyVersionHPKE}
+	for _, pk := range unlockKeys {
+		skE := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(skE); err != nil {
+			return nil, err
+		}
+		enc, ct, err := hpkeSeal(pubKeyBytes(pk), skE, []byte(key.Version), []byte(id), value)
+		if err != nil {
+			return nil, err
+		}
+		key.Recipients = append(key.Recipients, flowdata.KeyRecipient{
+			PublicKey: base64.StdEncoding.EncodeToString(pubKeyBytes(pk)),
+			Enc:       base64.StdEncoding.EncodeToString(enc),
+			Value:     base64.StdEncoding.EncodeToString(ct),
+		})
+	}
+	return key, nil
+}
+
+// UnwrapKey decrypts the copy of key record k for the X25519 private
+// key skR
+func UnwrapKey(skR []byte, k *flowdata.Key) ([]byte, error) {
+	if k.Version != flowdata.KeyVersionHPKE {
+		return nil, fmt.Errorf("unsupported key version: %s", k.Version)
+	}
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	recipient := base64.StdEncoding.EncodeToString(pkR)
+	for _, r := range k.Recipients {
+		if r.PublicKey != recipient {
+			continue
+		}
+		enc, err := base64.StdEncoding.DecodeString(r.Enc)
+		if err != nil {
+			return nil, err
+		}
+		ct, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		return hpkeOpen(skR, enc, []byte(k.Version), []byte(k.ID), ct)
+	}
+	return nil, fmt.Errorf("key %s is not wrapped for %s", k.ID, recipient)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
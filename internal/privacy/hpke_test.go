@@ -0,0 +1,134 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"golang.org/x/crypto/curve25519"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestHPKEKnownAnswer checks the first encryption of the base mode test
+// vector of RFC 9180, appendix A.2.1
+func TestHPKEKnownAnswer(t *testing.T) {
+	pkR := unhex(t, `4310ee97d88cc1f088a5576c77ab0cf5c3ac797f3d95139c6c84b5429c59662a`)
+	skR := unhex(t, `8057991eef8f1f1af18f4a9491d16a1ce333f695d4db8e38da75975c4478e0fb`)
+	skE := unhex(t, `f4ec9b33b792c372c1d2c2063507b684ef925b8c75a42dbcbf57d63ccd381600`)
+	info := unhex(t, `4f6465206f6e2061204772656369616e2055726e`)
+	pt := []byte(`Beauty is truth, truth beauty`)
+	aad := []byte(`Count-0`)
+
+	enc, ct, err := hpkeSeal(pkR, skE, info, aad, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `1afa08d3dec047a643885163f1180476fa7ddb54c6a8029ea33f95796bf2ac4a`; hex.EncodeToString(enc) != want {
+		t.Errorf("enc %x, want %s", enc, want)
+	}
+	if want := `1c5250d8034ec2b784ba2cfd69dbdb8af406cfe3ff938e131f0def8c8b60b4db21993c62ce81883d2dd1b51a28`; hex.EncodeToString(ct) != want {
+		t.Errorf("ciphertext %x, want %s", ct, want)
+	}
+	res, err := hpkeOpen(skR, enc, info, aad, ct)
+	if err != nil || !bytes.Equal(res, pt) {
+		t.Errorf("decrypted %q, %v", res, err)
+	}
+}
+
+// TestHPKESessionKeyVectors checks the published session key vectors
+func TestHPKESessionKeyVectors(t *testing.T) {
+	data, err := ioutil.ReadFile(`testdata/hpke-session-key.json`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := struct {
+		Info       string `json:"info"`
+		KeyID      string `json:"keyID"`
+		SessionKey string `json:"sessionKey"`
+		Recipients []struct {
+			SkR, PkR, SkE, Enc, Ct string
+		} `json:"recipients"`
+	}{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Info != flowdata.KeyVersionHPKE {
+		t.Fatalf("vectors of key version %s", v.Info)
+	}
+	sessionKey := unhex(t, v.SessionKey)
+
+	key := &flowdata.Key{ID: v.KeyID, Version: v.Info}
+	for _, r := range v.Recipients {
+		enc, ct, err := hpkeSeal(unhex(t, r.PkR), unhex(t, r.SkE), []byte(v.Info), []byte(v.KeyID), sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(enc) != r.Enc || hex.EncodeToString(ct) != r.Ct {
+			t.Errorf("recipient %s: enc %x, ciphertext %x", r.PkR, enc, ct)
+		}
+		key.Recipients = append(key.Recipients, flowdata.KeyRecipient{
+			PublicKey: base64.StdEncoding.EncodeToString(unhex(t, r.PkR)),
+			Enc:       base64.StdEncoding.EncodeToString(enc),
+			Value:     base64.StdEncoding.EncodeToString(ct),
+		})
+	}
+	for _, r := range v.Recipients {
+		res, err := UnwrapKey(unhex(t, r.SkR), key)
+		if err != nil || !bytes.Equal(res, sessionKey) {
+			t.Errorf("recipient %s unwrapped %x, %v", r.PkR, res, err)
+		}
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	skR := bytes.Repeat([]byte{0x42}, keyLenBytes)
+	pub, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkR := [keyLenBytes]uint8{}
+	copy(pkR[:], pub)
+
+	value := bytes.Repeat([]byte{0x17}, keyLenBytes)
+	key, err := wrapKey([]crypto.PublicKey{pkR}, `key`, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Version != flowdata.KeyVersionHPKE || len(key.Recipients) != 1 || key.ExportValue != `` {
+		t.Fatalf("unexpected key record: %+v", key)
+	}
+	res, err := UnwrapKey(skR, key)
+	if err != nil || !bytes.Equal(res, value) {
+		t.Errorf("unwrapped %x, %v", res, err)
+	}
+
+	// the key ID is authenticated
+	key.ID = `other`
+	if _, err := UnwrapKey(skR, key); err != ErrAuthentication {
+		t.Errorf("unwrapped a key with modified ID: %v", err)
+	}
+	if _, err := UnwrapKey(bytes.Repeat([]byte{0x43}, keyLenBytes), key); err == nil {
+		t.Errorf("unwrapped a key for another recipient")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,220 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/sirupsen/logrus"
+)
+
+// indexRecordsPerMessage limits the size of the published messages
+const indexRecordsPerMessage = 10000
+
+// indexKeyInfo is the HKDF info that derives the index encryption key
+// from the session key
+const indexKeyInfo = `privprod index key ` + flowdata.EnvelopeXChaCha20
+
+// recordIndex is the unpublished part of the reverse index of one
+// handler
+type recordIndex struct {
+	// epochs maps epoch IDs to pseudonyms to RecordIDs
+	epochs map[string]map[string][]string
+	size   int
+}
+
+// indexInterval returns the interval PRIVACY_INDEX_INTERVAL (default
+// 5m) in which the record index is published
+func indexInterval() (time.Duration, error) {
+	d := 5 * time.Minute
+	if err := loadEnv(envSetting{`PRIVACY_INDEX_INTERVAL`, envDuration(&d)}); err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid PRIVACY_INDEX_INTERVAL: %s", d)
+	}
+	return d, nil
+}
+
+func newRecordIndex() *recordIndex {
+	return &recordIndex{epochs: map[string]map[string][]string{}}
+}
+
+// add records that pseudonym of epoch appears in record recordID
+func (ix *recordIndex) add(epoch, pseudonym, recordID string) {
+	pseudonyms, ok := ix.epochs[epoch]
+	if !ok {
+		pseudonyms = map[string][]string{}
+		ix.epochs[epoch] = pseudonyms
+	}
+	ids := pseudonyms[pseudonym]
+	if len(ids) > 0 && ids[len(ids)-1] == recordID {
+		// source and destination share the pseudonym
+		return
+	}
+	pseudonyms[pseudonym] = append(ids, recordID)
+	ix.size++
+}
+
+// split returns the index as messages of at most
+// indexRecordsPerMessage references, and resets it
+func (ix *recordIndex) split() []flowdata.RecordIndex {
+	res := []flowdata.RecordIndex{}
+	epochs := make([]string, 0, len(ix.epochs))
+	for epoch := range ix.epochs {
+		epochs = append(epochs, epoch)
+	}
+	sort.Strings(epochs)
+
+	for _, epoch := range epochs {
+		pseudonyms := make([]string, 0, len(ix.epochs[epoch]))
+		for pseudonym := range ix.epochs[epoch] {
+			pseudonyms = append(pseudonyms, pseudonym)
+		}
+		sort.Strings(pseudonyms)
+
+		msg := flowdata.RecordIndex{Epoch: epoch}
+		size := 0
+		for _, pseudonym := range pseudonyms {
+			ids := ix.epochs[epoch][pseudonym]
+			for len(ids) > 0 {
+				n := indexRecordsPerMessage - size
+				if n > len(ids) {
+					n = len(ids)
+				}
+				msg.Entries = append(msg.Entries, flowdata.IndexEntry{
+					Pseudonym: pseudonym,
+					RecordIDs: ids[:n],
+				})
+				ids = ids[n:]
+				size += n
+				if size == indexRecordsPerMessage {
+					res = append(res, msg)
+					msg = flowdata.RecordIndex{Epoch: epoch}
+					size = 0
+				}
+			}
+		}
+		if size > 0 {
+			res = append(res, msg)
+		}
+	}
+	ix.epochs = map[string]map[string][]string{}
+	ix.size = 0
+	return res
+}
+
+// indexRecord adds the pseudonymized addresses of record r to the
+// reverse index of the handler, and publishes the index if it is full
+func (p *Protector) indexRecord(r *flowdata.Record, src, dst *policyEntry) {
+	if p.index == nil {
+		return
+	}
+	if src.Actions.has(actPseudonymize) {
+		p.index.add(r.PseudonymEpoch, r.SrcAddress, r.RecordID)
+	}
+	if dst.Actions.has(actPseudonymize) {
+		p.index.add(r.PseudonymEpoch, r.DstAddress, r.RecordID)
+	}
+	if p.index.size >= indexRecordsPerMessage {
+		p.flushIndex()
+	}
+}
+
+// flushIndex publishes the reverse index of the handler, encrypted with
+// its session key
+func (p *Protector) flushIndex() {
+	if p.index == nil || p.index.size == 0 {
+		return
+	}
+	aead, err := newAEAD(p.sessionKey, indexKeyInfo)
+	if err != nil {
+		logrus.Errorln(`privacy.Protector.flushIndex: ` + err.Error())
+		return
+	}
+	for _, msg := range p.index.split() {
+		enc, err := sealIndex(aead, msg, p.sessionKeyID)
+		if err != nil {
+			logrus.Errorln(`privacy.Protector.flushIndex: ` + err.Error())
+			continue
+		}
+		jb, err := json.Marshal(enc)
+		if err != nil {
+			logrus.Errorln(`privacy.Protector.flushIndex: ` + err.Error())
+			continue
+		}
+		p.dispatch <- &sarama.ProducerMessage{
+			Topic: p.topicIndex,
+			Value: sarama.ByteEncoder(jb),
+		}
+	}
+}
+
+// sealIndex encrypts one index message with aead, the index cipher of
+// the session key keyID
+func sealIndex(aead cipher.AEAD, msg flowdata.RecordIndex, keyID string) (*flowdata.EncryptedIndex, error) {
+	var plain bytes.Buffer
+	if err := gob.NewEncoder(&plain).Encode(msg); err != nil {
+		return nil, err
+	}
+	e := &flowdata.EncryptedIndex{
+		Version:      flowdata.EnvelopeXChaCha20,
+		Epoch:        msg.Epoch,
+		SessionKeyID: keyID,
+	}
+	nonce, value, err := sealAEAD(aead, plain.Bytes(), e.Version, e.Epoch, e.SessionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	e.Salt = base64.StdEncoding.EncodeToString(nonce)
+	e.Value = base64.StdEncoding.EncodeToString(value)
+	return e, nil
+}
+
+// OpenIndex verifies and decrypts the index message e with the session
+// key it was encrypted with
+func OpenIndex(sessionKey []byte, e *flowdata.EncryptedIndex) (*flowdata.RecordIndex, error) {
+	if e.Version != flowdata.EnvelopeXChaCha20 {
+		return nil, fmt.Errorf("unsupported envelope version: %s", e.Version)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	value, err := base64.StdEncoding.DecodeString(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(sessionKey, indexKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := openAEAD(aead, nonce, value, e.Version, e.Epoch, e.SessionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	msg := &flowdata.RecordIndex{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Epoch != e.Epoch {
+		return nil, fmt.Errorf("epoch mismatch: %s", msg.Epoch)
+	}
+	return msg, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,111 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestRecordIndexSplit(t *testing.T) {
+	ix := newRecordIndex()
+	// source and destination share the pseudonym
+	ix.add(`2021-07-14`, `0100:a000::1`, `r0`)
+	ix.add(`2021-07-14`, `0100:a000::1`, `r0`)
+	for i := 1; i <= indexRecordsPerMessage; i++ {
+		ix.add(`2021-07-14`, `0100:a000::1`, fmt.Sprintf("r%d", i))
+	}
+	ix.add(`2021-07-15`, `0100:a000::2`, `r1`)
+	if ix.size != indexRecordsPerMessage+2 {
+		t.Errorf("index size %d, want %d", ix.size, indexRecordsPerMessage+2)
+	}
+
+	msgs := ix.split()
+	if len(msgs) != 3 {
+		t.Fatalf("split into %d messages, want 3", len(msgs))
+	}
+	count := map[string]int{}
+	for _, msg := range msgs {
+		for _, e := range msg.Entries {
+			count[msg.Epoch+` `+e.Pseudonym] += len(e.RecordIDs)
+		}
+	}
+	if count[`2021-07-14 0100:a000::1`] != indexRecordsPerMessage+1 || count[`2021-07-15 0100:a000::2`] != 1 {
+		t.Errorf("unexpected index contents %v", count)
+	}
+	if ix.size != 0 || len(ix.epochs) != 0 {
+		t.Errorf("index not reset after split")
+	}
+}
+
+func TestRecordIndexEnvelope(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, keyLenBytes)
+	aead, err := newAEAD(key, indexKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := flowdata.RecordIndex{
+		Epoch:   `2021-07-14`,
+		Entries: []flowdata.IndexEntry{{Pseudonym: `0100:a000::1`, RecordIDs: []string{`r0`}}},
+	}
+	e, err := sealIndex(aead, msg, `session`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := OpenIndex(key, e)
+	if err != nil || !reflect.DeepEqual(*res, msg) {
+		t.Fatalf("decrypted %+v, %v", res, err)
+	}
+
+	// the sealed index, its nonce, epoch, key ID and version are
+	// authenticated
+	for _, f := range []func(e *flowdata.EncryptedIndex){
+		func(e *flowdata.EncryptedIndex) { e.Value = flipBit(e.Value, 0) },
+		func(e *flowdata.EncryptedIndex) { e.Salt = flipBit(e.Salt, 0) },
+		func(e *flowdata.EncryptedIndex) { e.Epoch = `2021-07-15` },
+		func(e *flowdata.EncryptedIndex) { e.SessionKeyID = `other` },
+	} {
+		m := *e
+		f(&m)
+		if _, err := OpenIndex(key, &m); err != ErrAuthentication {
+			t.Errorf("modified index decrypted: %v", err)
+		}
+	}
+	m := *e
+	m.Version = ``
+	if _, err := OpenIndex(key, &m); err == nil {
+		t.Errorf("index without envelope version decrypted")
+	}
+}
+
+func TestIndexInterval(t *testing.T) {
+	for _, c := range []struct {
+		env string
+		d   time.Duration
+		err bool
+	}{
+		{``, 5 * time.Minute, false},
+		{`30s`, 30 * time.Second, false},
+		{`0s`, 0, true},
+		{`-1m`, 0, true},
+		{`often`, 0, true},
+	} {
+		setenv(t, map[string]string{`PRIVACY_INDEX_INTERVAL`: c.env})
+		d, err := indexInterval()
+		if (err != nil) != c.err || d != c.d {
+			t.Errorf("%q: interval %s, error %v", c.env, d, err)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
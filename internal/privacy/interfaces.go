@@ -0,0 +1,191 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+// IPFIX flowDirection values
+const (
+	directionIngress = 0
+	directionEgress  = 1
+)
+
+// interfaceRule classifies one address of the records it matches,
+// based on the exporter and its interfaces instead of the address.
+// Unset conditions match every record.
+type interfaceRule struct {
+	agents    []*net.IPNet
+	ingress   *uint32
+	egress    *uint32
+	direction *uint8
+	// ingressZone and egressZone are the inventory zones of the
+	// interfaces
+	ingressZone string
+	egressZone  string
+	// dst is set if the rule classifies the destination address,
+	// otherwise it classifies the source address
+	dst   bool
+	entry *policyEntry
+}
+
+// policyFileInterface is the JSON representation of an interfaceRule
+type policyFileInterface struct {
+	Agents      []string `json:"agents,omitempty"`
+	Ingress     *uint32  `json:"ingress,omitempty"`
+	Egress      *uint32  `json:"egress,omitempty"`
+	Direction   string   `json:"direction,omitempty"`
+	IngressZone string   `json:"ingresszone,omitempty"`
+	EgressZone  string   `json:"egresszone,omitempty"`
+	Address     string   `json:"address"`
+	policyFileEntry
+}
+
+// matches reports if the rule applies to record r
+func (ir *interfaceRule) matches(r *flowdata.Record) bool {
+	switch {
+	case ir.ingress != nil && *ir.ingress != r.IngressIf:
+		return false
+	case ir.egress != nil && *ir.egress != r.EgressIf:
+		return false
+	case ir.direction != nil && *ir.direction != r.FlowDirection:
+		return false
+	case ir.ingressZone != `` && ir.ingressZone != r.IngressZone:
+		return false
+	case ir.egressZone != `` && ir.egressZone != r.EgressZone:
+		return false
+	case len(ir.agents) == 0:
+		return true
+	}
+	agent := net.ParseIP(r.AgentID)
+	for _, n := range ir.agents {
+		if n.Contains(agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupFlow returns the policy entries that apply to the source
+// address src and the destination address dst of record r. An
+// interface rule matching r replaces the entry of its address, unless
+// that entry has a higher priority.
+func (m *networkMap) lookupFlow(r *flowdata.Record, src, dst net.IP) (*policyEntry, *policyEntry) {
+	srcEntry, dstEntry := m.lookup(src), m.lookup(dst)
+	srcRule, dstRule := m.ruleFor(r, false), m.ruleFor(r, true)
+	if srcRule != nil && srcRule.Priority >= srcEntry.Priority {
+		srcEntry = srcRule
+	}
+	if dstRule != nil && dstRule.Priority >= dstEntry.Priority {
+		dstEntry = dstRule
+	}
+	return srcEntry, dstEntry
+}
+
+// ruleFor returns the entry of the interface rule with the highest
+// priority that matches r for the destination address if dst is set,
+// otherwise for the source address. On equal priority, rules of the
+// exporter's scope take precedence over global rules, otherwise the
+// rule defined first applies.
+func (m *networkMap) ruleFor(r *flowdata.Record, dst bool) *policyEntry {
+	var res *policyEntry
+	for _, ir := range m.rules {
+		if ir.dst != dst || !ir.matches(r) {
+			continue
+		}
+		switch {
+		case res == nil, ir.entry.Priority > res.Priority:
+			res = ir.entry
+		case ir.entry.Priority == res.Priority && res.Scope == `` && ir.entry.Scope != ``:
+			res = ir.entry
+		}
+	}
+	return res
+}
+
+// parseInterfaces adds the interface rules raws to m. They are searched
+// within the policy file from position base onwards.
+func (pp *policyParser) parseInterfaces(m *networkMap, scope string, raws []json.RawMessage, base int) {
+	offset := base
+	for i := range raws {
+		start := pp.offset(offset, raws[i])
+		offset = start + len(raws[i])
+		source := pp.source(start)
+
+		pfi := policyFileInterface{}
+		decoder := json.NewDecoder(bytes.NewReader(raws[i]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&pfi); err != nil {
+			pp.errs = append(pp.errs, errAt(source, err.Error()))
+			continue
+		}
+		ir, err := pfi.rule(source, m.classes)
+		if err != nil {
+			pp.errs = append(pp.errs, err)
+			continue
+		}
+		ir.entry.Scope = scope
+		m.rules = append(m.rules, ir)
+	}
+}
+
+// rule converts the file representation into a validated
+// interfaceRule
+func (pfi *policyFileInterface) rule(source string, classes map[string]*policyClass) (*interfaceRule, error) {
+	ir := &interfaceRule{
+		ingress:     pfi.Ingress,
+		egress:      pfi.Egress,
+		ingressZone: pfi.IngressZone,
+		egressZone:  pfi.EgressZone,
+	}
+	switch pfi.Address {
+	case `src`:
+	case `dst`:
+		ir.dst = true
+	default:
+		return nil, errAt(source, fmt.Sprintf(
+			"invalid address %q, expected src or dst", pfi.Address))
+	}
+
+	var d uint8
+	switch pfi.Direction {
+	case ``:
+	case `ingress`:
+		d = directionIngress
+		ir.direction = &d
+	case `egress`:
+		d = directionEgress
+		ir.direction = &d
+	default:
+		return nil, errAt(source, fmt.Sprintf(
+			"invalid direction %q, expected ingress or egress", pfi.Direction))
+	}
+
+	for _, agent := range pfi.Agents {
+		n, err := parseAgent(agent)
+		if err != nil {
+			return nil, errAt(source, err.Error())
+		}
+		ir.agents = append(ir.agents, n)
+	}
+
+	if pfi.Prefix != `` {
+		return nil, errAt(source, `prefix not allowed`)
+	}
+	var err error
+	ir.entry, err = pfi.entry(source, classes)
+	return ir, err
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
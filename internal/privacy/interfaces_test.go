@@ -0,0 +1,60 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestInterfaceRules(t *testing.T) {
+	m := newNetworkMap()
+	m.add(&policyEntry{
+		Network:  mustCIDR(`203.0.113.0/24`),
+		Class:    classDiscard,
+		Actions:  actDiscard,
+		Priority: legacyPriorityDiscard,
+	})
+	ingress := uint32(12)
+	pfi := policyFileInterface{
+		Agents:    []string{`192.0.2.20`},
+		Ingress:   &ingress,
+		Direction: `ingress`,
+		Address:   `src`,
+	}
+	pfi.Class = classEmployeePub
+	ir, err := pfi.rule(`test`, m.classes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.rules = append(m.rules, ir)
+
+	for _, c := range []struct {
+		agent, src    string
+		ingress       uint32
+		direction     uint8
+		srcClass, dst string
+	}{
+		{`192.0.2.20`, `8.8.8.8`, 12, directionIngress, classEmployeePub, classCustomer},
+		{`192.0.2.20`, `8.8.8.8`, 13, directionIngress, classCustomer, classCustomer},
+		{`192.0.2.20`, `8.8.8.8`, 12, directionEgress, classCustomer, classCustomer},
+		{`192.0.2.21`, `8.8.8.8`, 12, directionIngress, classCustomer, classCustomer},
+		// entries of higher priority are not replaced
+		{`192.0.2.20`, `203.0.113.1`, 12, directionIngress, classDiscard, classCustomer},
+	} {
+		r := &flowdata.Record{AgentID: c.agent, IngressIf: c.ingress, FlowDirection: c.direction}
+		src, dst := m.lookupFlow(r, net.ParseIP(c.src), net.ParseIP(`9.9.9.9`))
+		if src.Class != c.srcClass || dst.Class != c.dst {
+			t.Errorf("%+v: got %s/%s, want %s/%s", c, src.Class, dst.Class, c.srcClass, c.dst)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,133 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+// inventory is a parsed and immutable inventory file
+type inventory struct {
+	// exporters are keyed by the canonical form of their addresses
+	exporters map[string]*inventoryExporter
+	count     int
+}
+
+type inventoryExporter struct {
+	Site       string
+	Interfaces map[uint32]inventoryInterface
+}
+
+type inventoryInterface struct {
+	Name string
+	Zone string
+}
+
+// inventoryFile is the JSON representation of an inventory file, its
+// format is described in README.md
+type inventoryFile struct {
+	Exporters []struct {
+		Addresses  []string `json:"addresses"`
+		Site       string   `json:"site,omitempty"`
+		Interfaces []struct {
+			Index uint32 `json:"index"`
+			Name  string `json:"name,omitempty"`
+			Zone  string `json:"zone,omitempty"`
+		} `json:"interfaces,omitempty"`
+	} `json:"exporters"`
+}
+
+// loadInventory parses the inventory file fname
+func loadInventory(fname string) (*inventory, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	inf := inventoryFile{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&inf); err != nil {
+		return nil, jsonError(fname, data, err)
+	}
+
+	inv := &inventory{exporters: map[string]*inventoryExporter{}}
+	for i, ie := range inf.Exporters {
+		source := fmt.Sprintf("%s: exporter %d", fname, i+1)
+		exp := &inventoryExporter{
+			Site:       ie.Site,
+			Interfaces: map[uint32]inventoryInterface{},
+		}
+		for _, ii := range ie.Interfaces {
+			if _, ok := exp.Interfaces[ii.Index]; ok {
+				return nil, errAt(source, fmt.Sprintf(
+					"duplicate interface index %d", ii.Index))
+			}
+			exp.Interfaces[ii.Index] = inventoryInterface{Name: ii.Name, Zone: ii.Zone}
+		}
+		if len(ie.Addresses) == 0 {
+			return nil, errAt(source, `no addresses configured`)
+		}
+		for _, addr := range ie.Addresses {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errAt(source, fmt.Sprintf("invalid address: %s", addr))
+			}
+			if _, ok := inv.exporters[ip.String()]; ok {
+				return nil, errAt(source, fmt.Sprintf("duplicate address %s", addr))
+			}
+			inv.exporters[ip.String()] = exp
+		}
+		inv.count++
+	}
+	return inv, nil
+}
+
+// exporter returns the inventory entry of the exporter of record r,
+// or nil
+func (inv *inventory) exporter(r *flowdata.Record) *inventoryExporter {
+	for _, addr := range []string{r.AgentID, r.ExpIPv4Addr, r.ExpIPv6Addr} {
+		if addr == `` {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if exp, ok := inv.exporters[ip.String()]; ok {
+			return exp
+		}
+	}
+	return nil
+}
+
+// enrich adds the site, interface names and zones of the exporter of
+// record r to r
+func (inv *inventory) enrich(r *flowdata.Record) {
+	if inv == nil {
+		return
+	}
+	exp := inv.exporter(r)
+	if exp == nil {
+		return
+	}
+	r.Site = exp.Site
+	if ii, ok := exp.Interfaces[r.IngressIf]; ok {
+		r.IngressName, r.IngressZone = ii.Name, ii.Zone
+	}
+	if ii, ok := exp.Interfaces[r.EgressIf]; ok {
+		r.EgressName, r.EgressZone = ii.Name, ii.Zone
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
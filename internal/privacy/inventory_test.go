@@ -0,0 +1,108 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestInventory(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`inventory.json`: `{"exporters": [
+	  {"addresses": ["192.0.2.20", "2001:db8::20"], "site": "fra1", "interfaces": [
+	    {"index": 12, "name": "ge-0/0/1.0", "zone": "vpn-inside"},
+	    {"index": 13, "name": "ge-0/0/2.0", "zone": "internet"}
+	  ]},
+	  {"addresses": ["192.0.2.30"], "site": "ams1"}
+	]}`})
+	inv, err := loadInventory(filepath.Join(dir, `inventory.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.count != 2 {
+		t.Errorf("%d exporters, want 2", inv.count)
+	}
+
+	for _, c := range []struct {
+		name string
+		in   flowdata.Record
+		out  flowdata.Record
+	}{
+		{`agent`,
+			flowdata.Record{AgentID: `192.0.2.20`, IngressIf: 12, EgressIf: 13},
+			flowdata.Record{Site: `fra1`, IngressName: `ge-0/0/1.0`, IngressZone: `vpn-inside`,
+				EgressName: `ge-0/0/2.0`, EgressZone: `internet`}},
+		{`exporter address in another notation`,
+			flowdata.Record{AgentID: `198.51.100.1`, ExpIPv6Addr: `2001:0db8:0::20`, IngressIf: 13},
+			flowdata.Record{Site: `fra1`, IngressName: `ge-0/0/2.0`, IngressZone: `internet`}},
+		{`unknown interface`,
+			flowdata.Record{ExpIPv4Addr: `192.0.2.20`, IngressIf: 99},
+			flowdata.Record{Site: `fra1`}},
+		{`without interfaces`,
+			flowdata.Record{AgentID: `192.0.2.30`, IngressIf: 12},
+			flowdata.Record{Site: `ams1`}},
+		{`unknown exporter`,
+			flowdata.Record{AgentID: `192.0.2.40`, ExpIPv4Addr: `invalid`, IngressIf: 12},
+			flowdata.Record{}},
+	} {
+		r := c.in
+		inv.enrich(&r)
+		if r.Site != c.out.Site || r.IngressName != c.out.IngressName ||
+			r.IngressZone != c.out.IngressZone || r.EgressName != c.out.EgressName ||
+			r.EgressZone != c.out.EgressZone {
+			t.Errorf("%s: enriched with %q %q %q %q %q", c.name, r.Site,
+				r.IngressName, r.IngressZone, r.EgressName, r.EgressZone)
+		}
+	}
+
+	// without an inventory, records are left unchanged
+	var none *inventory
+	r := flowdata.Record{AgentID: `192.0.2.20`, IngressIf: 12}
+	none.enrich(&r)
+	if r.Site != `` || r.IngressName != `` {
+		t.Errorf("record enriched without inventory")
+	}
+}
+
+func TestInventoryErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, data, err string
+	}{
+		{`syntax`, "{\"exporters\": [\n{\"addresses\": [\"192.0.2.20\"],}]}", `inventory.json:2: invalid character`},
+		{`unknown field`, `{"exporters": [{"addresses": ["192.0.2.20"], "zone": "x"}]}`, `unknown field "zone"`},
+		{`negative index`,
+			`{"exporters": [{"addresses": ["192.0.2.20"], "interfaces": [{"index": -1}]}]}`,
+			`cannot unmarshal number -1`},
+		{`no addresses`, `{"exporters": [{"site": "fra1"}]}`, `exporter 1: no addresses configured`},
+		{`invalid address`,
+			`{"exporters": [{"addresses": ["192.0.2.20"]}, {"addresses": ["192.0.2.0/24"]}]}`,
+			`exporter 2: invalid address: 192.0.2.0/24`},
+		{`duplicate address`,
+			`{"exporters": [{"addresses": ["2001:db8::20"]}, {"addresses": ["2001:db8:0::20"]}]}`,
+			`exporter 2: duplicate address 2001:db8:0::20`},
+		{`duplicate interface`,
+			`{"exporters": [{"addresses": ["192.0.2.20"], "interfaces": [{"index": 12}, {"index": 12}]}]}`,
+			`exporter 1: duplicate interface index 12`},
+	} {
+		dir := writeTestFiles(t, map[string]string{`inventory.json`: c.data})
+		if _, err := loadInventory(filepath.Join(dir, `inventory.json`)); err == nil {
+			t.Errorf("%s: inventory accepted", c.name)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %q, want %q", c.name, err, c.err)
+		}
+	}
+
+	if _, err := loadInventory(filepath.Join(writeTestFiles(t, nil), `missing.json`)); err == nil {
+		t.Errorf("missing inventory file accepted")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
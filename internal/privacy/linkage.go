@@ -0,0 +1,302 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// linkagePairsPerMessage limits the size of the published messages
+const linkagePairsPerMessage = 5000
+
+// linkageKeyInfo is the HKDF info that derives the linkage map
+// encryption key from the linkage key
+const linkageKeyInfo = `privprod linkage key ` + flowdata.EnvelopeXChaCha20
+
+// linkageTracker remembers the pseudonymized addresses of the
+// linkable classes per epoch
+type linkageTracker struct {
+	classes map[string]bool
+	limit   int
+	lock    sync.Mutex
+	// newest is the newest epoch a record was pseudonymized in
+	newest *pseudonymKey
+	epochs map[string]*linkageEpoch
+	count  int
+	full   bool
+}
+
+// linkageEpoch holds the addresses of one epoch, keyed by their
+// pseudonym
+type linkageEpoch struct {
+	key  *pseudonymKey
+	seen map[string]linkageAddress
+}
+
+type linkageAddress struct {
+	ip    net.IP
+	class *policyClass
+}
+
+// linkage is the tracker of all handlers, nil if linkage maps are
+// disabled
+var linkage *linkageTracker
+
+// newLinkageTracker configures the tracker from the environment, it
+// returns nil if no class is linkable
+func newLinkageTracker() (*linkageTracker, error) {
+	v := os.Getenv(`PRIVACY_LINKAGE_CLASSES`)
+	if v == `` {
+		return nil, nil
+	}
+	lt := &linkageTracker{
+		classes: map[string]bool{},
+		limit:   1000000,
+		epochs:  map[string]*linkageEpoch{},
+	}
+	for _, class := range strings.Split(v, `,`) {
+		lt.classes[strings.TrimSpace(class)] = true
+	}
+	if l := os.Getenv(`PRIVACY_LINKAGE_LIMIT`); l != `` {
+		var err error
+		if lt.limit, err = strconv.Atoi(l); err != nil || lt.limit <= 0 {
+			return nil, fmt.Errorf("invalid PRIVACY_LINKAGE_LIMIT: %s", l)
+		}
+	}
+	return lt, nil
+}
+
+// observe remembers that ip of class c was pseudonymized to pseudonym
+// with key k
+func (lt *linkageTracker) observe(k *pseudonymKey, c *policyClass, ip net.IP, pseudonym string) {
+	if lt == nil || k.id == epochStatic || !lt.classes[c.Name] {
+		return
+	}
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	e, ok := lt.epochs[k.id]
+	if !ok {
+		e = &linkageEpoch{key: k, seen: map[string]linkageAddress{}}
+		lt.epochs[k.id] = e
+	}
+	if _, ok := e.seen[pseudonym]; ok {
+		return
+	}
+	if lt.count >= lt.limit {
+		if !lt.full {
+			logrus.Warnf("Privacy: linkage limit of %d addresses reached\n", lt.limit)
+			lt.full = true
+		}
+		return
+	}
+	e.seen[pseudonym] = linkageAddress{ip: ip, class: c}
+	lt.count++
+}
+
+// rotate reports the use of key k. If k is newer than all keys used
+// before, it returns the remembered epochs that must be published.
+func (lt *linkageTracker) rotate(k *pseudonymKey) []*linkageEpoch {
+	if lt == nil || k.id == epochStatic {
+		return nil
+	}
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	switch {
+	case lt.newest == nil:
+		lt.newest = k
+		return nil
+	case !k.start.After(lt.newest.start):
+		return nil
+	}
+	lt.newest = k
+
+	done := []*linkageEpoch{}
+	for id, e := range lt.epochs {
+		if e.key.start.Before(k.start) {
+			done = append(done, e)
+			lt.count -= len(e.seen)
+			delete(lt.epochs, id)
+		}
+	}
+	lt.full = false
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].key.start.Before(done[j].key.start)
+	})
+	return done
+}
+
+// pairs returns the linkage of e to the following epoch
+func (e *linkageEpoch) pairs() (*flowdata.Linkage, error) {
+	next, err := pseudoKeys.at(e.key.end)
+	if err != nil {
+		return nil, err
+	}
+	l := &flowdata.Linkage{FromEpoch: e.key.id, ToEpoch: next.id}
+	for from, a := range e.seen {
+		to, _ := pseudonymize(a.ip, a.class, next)
+		l.Pairs = append(l.Pairs, flowdata.LinkagePair{
+			Class: a.class.Name,
+			From:  formatAddress(from),
+			To:    formatAddress(to),
+		})
+	}
+	sort.Slice(l.Pairs, func(i, j int) bool {
+		return l.Pairs[i].From < l.Pairs[j].From
+	})
+	return l, nil
+}
+
+// publishLinkage publishes the linkage maps of the epochs done,
+// encrypted with a new key that is wrapped for the unlock keys
+func (p *Protector) publishLinkage(done []*linkageEpoch) {
+	if len(done) == 0 {
+		return
+	}
+	if p.topicLinkage == `` {
+		logrus.Warnln(`Privacy: no kafka topic for linkage maps configured`)
+		return
+	}
+
+	// generate and publish the linkage key
+	lkey := make([]byte, keyLenBytes)
+	if _, err := rand.Read(lkey); err != nil {
+		logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+		return
+	}
+	keyID := uuid.NewV4().String()
+	key, err := wrapKey(p.unlockKeys, keyID, lkey)
+	if err != nil {
+		logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+		return
+	}
+	jb, err := json.Marshal(key)
+	if err != nil {
+		logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+		return
+	}
+	p.dispatch <- &sarama.ProducerMessage{
+		Topic: p.topicSKey,
+		Value: sarama.ByteEncoder(jb),
+	}
+	aead, err := newAEAD(lkey, linkageKeyInfo)
+	if err != nil {
+		logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+		return
+	}
+
+	for _, e := range done {
+		l, err := e.pairs()
+		if err != nil {
+			logrus.Errorf("Privacy: no linkage map for epoch %s: %s\n",
+				e.key.id, err.Error())
+			continue
+		}
+		for start := 0; start < len(l.Pairs); start += linkagePairsPerMessage {
+			end := start + linkagePairsPerMessage
+			if end > len(l.Pairs) {
+				end = len(l.Pairs)
+			}
+			part := flowdata.Linkage{
+				FromEpoch: l.FromEpoch,
+				ToEpoch:   l.ToEpoch,
+				Pairs:     l.Pairs[start:end],
+			}
+			enc, err := sealLinkage(aead, part, keyID)
+			if err != nil {
+				logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+				return
+			}
+			jb, err := json.Marshal(enc)
+			if err != nil {
+				logrus.Errorln(`privacy.Protector.publishLinkage: ` + err.Error())
+				return
+			}
+			p.dispatch <- &sarama.ProducerMessage{
+				Topic: p.topicLinkage,
+				Value: sarama.ByteEncoder(jb),
+			}
+		}
+		logrus.Infof("Privacy: published linkage of %d pseudonyms from epoch %s to %s\n",
+			len(l.Pairs), l.FromEpoch, l.ToEpoch)
+	}
+}
+
+// sealLinkage encrypts one linkage message with aead, the cipher of
+// the linkage key keyID
+func sealLinkage(aead cipher.AEAD, l flowdata.Linkage, keyID string) (*flowdata.EncryptedLinkage, error) {
+	var plain bytes.Buffer
+	if err := gob.NewEncoder(&plain).Encode(l); err != nil {
+		return nil, err
+	}
+	e := &flowdata.EncryptedLinkage{
+		Version:      flowdata.EnvelopeXChaCha20,
+		FromEpoch:    l.FromEpoch,
+		ToEpoch:      l.ToEpoch,
+		SessionKeyID: keyID,
+	}
+	nonce, value, err := sealAEAD(aead, plain.Bytes(), e.Version, e.FromEpoch, e.ToEpoch, e.SessionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	e.Salt = base64.StdEncoding.EncodeToString(nonce)
+	e.Value = base64.StdEncoding.EncodeToString(value)
+	return e, nil
+}
+
+// OpenLinkage verifies and decrypts the linkage message e with the
+// linkage key it was encrypted with
+func OpenLinkage(key []byte, e *flowdata.EncryptedLinkage) (*flowdata.Linkage, error) {
+	if e.Version != flowdata.EnvelopeXChaCha20 {
+		return nil, fmt.Errorf("unsupported envelope version: %s", e.Version)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	value, err := base64.StdEncoding.DecodeString(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key, linkageKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := openAEAD(aead, nonce, value, e.Version, e.FromEpoch, e.ToEpoch, e.SessionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	l := &flowdata.Linkage{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(l); err != nil {
+		return nil, err
+	}
+	if l.FromEpoch != e.FromEpoch || l.ToEpoch != e.ToEpoch {
+		return nil, fmt.Errorf("epoch mismatch: %s to %s", l.FromEpoch, l.ToEpoch)
+	}
+	return l, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
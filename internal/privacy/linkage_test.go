@@ -0,0 +1,122 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestLinkageRotation(t *testing.T) {
+	defer func(s *keySchedule) { pseudoKeys = s }(pseudoKeys)
+	pseudoKeys = &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+
+	lt := &linkageTracker{
+		classes: map[string]bool{classEmployeePriv: true},
+		limit:   10,
+		epochs:  map[string]*linkageEpoch{},
+	}
+	classes := builtinClasses()
+	priv, cust := classes[classEmployeePriv], classes[classCustomer]
+
+	day1, _ := time.Parse(time.RFC3339, `2021-07-14T12:00:00Z`)
+	k1, _ := pseudoKeys.at(day1)
+	k2, _ := pseudoKeys.at(day1.Add(24 * time.Hour))
+
+	if done := lt.rotate(k1); len(done) != 0 {
+		t.Fatalf("first epoch published %d linkage maps", len(done))
+	}
+	ip := net.ParseIP(`10.1.2.3`).To16()
+	from, _ := pseudonymize(ip, priv, k1)
+	for i := 0; i < 3; i++ {
+		lt.observe(k1, priv, ip, from)
+	}
+	p, _ := pseudonymize(net.ParseIP(`192.0.2.1`).To16(), cust, k1)
+	lt.observe(k1, cust, net.ParseIP(`192.0.2.1`).To16(), p)
+
+	if done := lt.rotate(k1); len(done) != 0 {
+		t.Errorf("linkage published without rotation")
+	}
+	done := lt.rotate(k2)
+	if len(done) != 1 {
+		t.Fatalf("rotation published %d linkage maps, want 1", len(done))
+	}
+	l, err := done[0].pairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _ := pseudonymize(ip, priv, k2)
+	if l.FromEpoch != k1.id || l.ToEpoch != k2.id {
+		t.Errorf("linkage from %s to %s, want %s to %s", l.FromEpoch, l.ToEpoch, k1.id, k2.id)
+	}
+	if len(l.Pairs) != 1 || l.Pairs[0].From != formatAddress(from) || l.Pairs[0].To != formatAddress(to) {
+		t.Errorf("unexpected linkage pairs %v", l.Pairs)
+	}
+	if lt.count != 0 {
+		t.Errorf("%d addresses remembered after rotation", lt.count)
+	}
+}
+
+func TestLinkageEnvelope(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, keyLenBytes)
+	aead, err := newAEAD(key, linkageKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := flowdata.Linkage{
+		FromEpoch: `2021-07-14`,
+		ToEpoch:   `2021-07-15`,
+		Pairs:     []flowdata.LinkagePair{{Class: classEmployeePriv, From: `a`, To: `b`}},
+	}
+	e, err := sealLinkage(aead, l, `key`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != flowdata.EnvelopeXChaCha20 {
+		t.Errorf("envelope version %s", e.Version)
+	}
+	res, err := OpenLinkage(key, e)
+	if err != nil || !reflect.DeepEqual(*res, l) {
+		t.Fatalf("decrypted %+v, %v", res, err)
+	}
+
+	// the sealed chunk, its nonce, epochs and key ID are authenticated
+	for _, f := range []func(e *flowdata.EncryptedLinkage){
+		func(e *flowdata.EncryptedLinkage) { e.Value = flipBit(e.Value, 0) },
+		func(e *flowdata.EncryptedLinkage) { e.Value = flipBit(e.Value, len(e.Value)/2) },
+		func(e *flowdata.EncryptedLinkage) { e.Salt = flipBit(e.Salt, 0) },
+		func(e *flowdata.EncryptedLinkage) { e.FromEpoch = `2021-07-13` },
+		func(e *flowdata.EncryptedLinkage) { e.ToEpoch = `2021-07-16` },
+		func(e *flowdata.EncryptedLinkage) { e.SessionKeyID = `other` },
+	} {
+		m := *e
+		f(&m)
+		if _, err := OpenLinkage(key, &m); err != ErrAuthentication {
+			t.Errorf("modified linkage decrypted: %v", err)
+		}
+	}
+}
+
+// flipBit returns the base64 encoded value b64 with the lowest bit of
+// its byte i inverted
+func flipBit(b64 string, i int) string {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || i >= len(b) {
+		return b64
+	}
+	b[i] ^= 1
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
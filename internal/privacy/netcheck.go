@@ -0,0 +1,386 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity levels of a Finding
+const (
+	LevelError   = `error`
+	LevelWarning = `warning`
+)
+
+// Finding is a problem detected within the network or policy files
+type Finding struct {
+	Source  string
+	Level   string
+	Message string
+}
+
+func (f Finding) String() string {
+	if f.Source == `` {
+		return fmt.Sprintf("%s: %s", f.Level, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Source, f.Level, f.Message)
+}
+
+// CheckNetworks parses the network maps of cfg: every version of the
+// versions file, or else the policy file, or the legacy network files
+// if no policy file is set, together with the inventory file. It
+// reports all syntax errors, as well as overlapping, shadowed and
+// redundant entries, networks that never reach the classification
+// they are listed for and interface rules matching zones the inventory
+// does not define.
+func CheckNetworks(cfg NetworkConfig) []Finding {
+	var findings []Finding
+	if cfg.VersionsFile != `` {
+		findings = checkVersions(cfg.VersionsFile)
+	} else {
+		findings = checkNetworks(cfg.PolicyFile, cfg.Path, cfg.InventoryFile)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		fi, li := splitSource(findings[i].Source)
+		fj, lj := splitSource(findings[j].Source)
+		if fi != fj {
+			return fi < fj
+		}
+		return li < lj
+	})
+	return findings
+}
+
+// checkVersions checks all versions of the versions file fname
+func checkVersions(fname string) []Finding {
+	versions, err := parseVersionsFile(fname)
+	if err != nil {
+		return []Finding{errorFinding(err)}
+	}
+
+	findings := []Finding{}
+	ids := map[string]string{}
+	effective := map[int64]string{}
+	for _, v := range versions {
+		if first, ok := ids[v.ID]; ok && v.ID != `` {
+			findings = append(findings, Finding{
+				Source:  v.source,
+				Level:   LevelError,
+				Message: fmt.Sprintf("duplicate version %s, first defined at %s", v.ID, first),
+			})
+		}
+		ids[v.ID] = v.source
+		if first, ok := effective[v.Effective.UnixNano()]; ok {
+			findings = append(findings, Finding{
+				Source:  v.source,
+				Level:   LevelError,
+				Message: fmt.Sprintf("effective at the same time as %s", first),
+			})
+		}
+		effective[v.Effective.UnixNano()] = v.source
+		findings = append(findings, checkNetworks(v.Policy, v.Path, v.Inventory)...)
+	}
+	return findings
+}
+
+// checkNetworks checks the policy file policyFile, or the legacy
+// network files within cfgPath if policyFile is empty, and the
+// inventory file inventoryFile if set
+func checkNetworks(policyFile, cfgPath, inventoryFile string) []Finding {
+	var m *networkMap
+	var legacy []legacyNetworks
+	var errs []error
+
+	if policyFile != `` {
+		m, _, legacy, errs = parsePolicyFile(policyFile)
+	} else {
+		var l legacyNetworks
+		l, errs = parseLegacyNetworks(cfgPath)
+		legacy = []legacyNetworks{l}
+		m = newNetworkMap()
+		l.importInto(m, ``)
+		if registry, err := legacyRegistry(); err != nil {
+			errs = append(errs, err)
+		} else if registry {
+			m.addRegistry()
+		}
+	}
+
+	var inv *inventory
+	if inventoryFile != `` {
+		var err error
+		if inv, err = loadInventory(inventoryFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	findings := []Finding{}
+	for _, err := range errs {
+		findings = append(findings, errorFinding(err))
+	}
+	if m != nil {
+		for _, l := range legacy {
+			findings = append(findings, l.check()...)
+		}
+		findings = append(findings, m.check()...)
+		findings = append(findings, m.checkZones(inv, inventoryFile != ``)...)
+		for _, sm := range m.scopes {
+			findings = append(findings, sm.check()...)
+			findings = append(findings, sm.checkZones(inv, inventoryFile != ``)...)
+		}
+	}
+	return findings
+}
+
+// errorFinding converts err into a Finding
+func errorFinding(err error) Finding {
+	f := Finding{Level: LevelError, Message: err.Error()}
+	if se, ok := err.(*sourceError); ok {
+		f.Source, f.Message = se.source, se.msg
+	}
+	return f
+}
+
+// check reports duplicate and nested networks within each legacy
+// network file, and employee networks outside of the reserved or
+// company networks they must be contained in
+func (l legacyNetworks) check() []Finding {
+	findings := []Finding{}
+
+	for _, fname := range networkFiles {
+		seen := map[string]string{}
+		trie := newNetTrie()
+		for _, ln := range l[fname] {
+			if first, ok := seen[ln.network.String()]; ok {
+				findings = append(findings, Finding{
+					Source: ln.source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("duplicate network %s, first listed at %s",
+						ln.network, first),
+				})
+				continue
+			}
+			seen[ln.network.String()] = ln.source
+			trie.Insert(&policyEntry{Network: ln.network, Source: ln.source})
+		}
+		for _, ln := range l[fname] {
+			for _, o := range trie.Matches(ln.network.IP) {
+				if prefixLen(o.Network) < prefixLen(ln.network) {
+					findings = append(findings, Finding{
+						Source: ln.source,
+						Level:  LevelWarning,
+						Message: fmt.Sprintf("network %s is redundant, contained in %s at %s",
+							ln.network, o.Network, o.Source),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		fname, within, class string
+	}{
+		{`employee-private.txt`, `reserved.txt`, classEmployeePriv},
+		{`employee-public.txt`, `company-public.txt`, classEmployeePub},
+	} {
+		for _, ln := range l[c.fname] {
+			contained := false
+			partial := []string{}
+			for _, outer := range l[c.within] {
+				switch intersect(ln.network, outer.network) {
+				case nil:
+				case ln.network:
+					contained = true
+				default:
+					if !inList(partial, outer.network.String()) {
+						partial = append(partial, outer.network.String())
+					}
+				}
+			}
+			switch {
+			case contained:
+			case len(partial) == 0:
+				findings = append(findings, Finding{
+					Source: ln.source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("network %s is not within any network of %s"+
+						" and is never classified as %s", ln.network, c.within, c.class),
+				})
+			default:
+				findings = append(findings, Finding{
+					Source: ln.source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("network %s is only partially within %s,"+
+						" only %s are classified as %s", ln.network, c.within,
+						strings.Join(partial, `, `), c.class),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// check reports policy entries of the scope of m that never apply
+// because an entry covering their whole network takes precedence,
+// entries that are redundant with the entry that would apply in their
+// place and discard entries overlapping entries of other classes
+func (m *networkMap) check() []Finding {
+	findings := []Finding{}
+
+	m.trie.Walk(func(e *policyEntry) {
+		if e.Scope != m.scope || e.builtin {
+			// global entries are checked within the global map, the
+			// special-purpose registry is not checked at all
+			return
+		}
+		// all other entries whose network contains the network of e,
+		// in order of precedence
+		outer := []*policyEntry{}
+		for _, o := range m.trie.Matches(e.Network.IP) {
+			if o == e || prefixLen(o.Network) > prefixLen(e.Network) {
+				continue
+			}
+			if e.imported && o.imported && e.Class == o.Class {
+				// reported by the legacy network file checks
+				continue
+			}
+			outer = append(outer, o)
+		}
+		// the special-purpose registry never precedes an entry of the
+		// same or a longer prefix
+		sort.Slice(outer, func(i, j int) bool {
+			if outer[i].builtin != outer[j].builtin {
+				return outer[j].builtin
+			}
+			return outer[i].precedes(outer[j])
+		})
+
+		for _, o := range outer {
+			switch {
+			case !o.builtin && o.precedes(e):
+				if e.imported && o.imported && e.Class == classInfrastructure {
+					// legacy reserved and company networks are expected
+					// to contain the employee networks
+					continue
+				}
+				msg := fmt.Sprintf("%s network %s is shadowed by %s network %s at %s and never applies",
+					e.Class, e.Network, o.Class, o.Network, o.Source)
+				if prefixLen(o.Network) == prefixLen(e.Network) {
+					msg = fmt.Sprintf("%s network %s is also listed as %s at %s, which takes precedence",
+						e.Class, e.Network, o.Class, o.Source)
+				}
+				findings = append(findings, Finding{
+					Source:  e.Source,
+					Level:   LevelWarning,
+					Message: msg,
+				})
+				return
+			case prefixLen(o.Network) == prefixLen(e.Network):
+				// reported for the entry that is shadowed
+			case e.Actions.has(actDiscard) != o.Actions.has(actDiscard):
+				findings = append(findings, Finding{
+					Source: e.Source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("%s network %s overlaps %s network %s at %s",
+						e.Class, e.Network, o.Class, o.Network, o.Source),
+				})
+				return
+			case o == outer[0] && e.Class == o.Class && e.Actions == o.Actions &&
+				strings.Join(e.Labels, `,`) == strings.Join(o.Labels, `,`):
+				findings = append(findings, Finding{
+					Source: e.Source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("%s network %s is redundant, contained in %s at %s",
+						e.Class, e.Network, o.Network, o.Source),
+				})
+				return
+			}
+		}
+	})
+	return findings
+}
+
+// checkZones reports interface rules of the scope of m that match
+// zones no interface of inventory inv belongs to, and thus never
+// apply. Configured is false if no inventory file is used, and inv is
+// nil if it could not be read.
+func (m *networkMap) checkZones(inv *inventory, configured bool) []Finding {
+	zones := map[string]bool{}
+	if inv != nil {
+		for _, exp := range inv.exporters {
+			for _, ii := range exp.Interfaces {
+				zones[ii.Zone] = true
+			}
+		}
+	}
+
+	findings := []Finding{}
+	for _, ir := range m.rules {
+		if ir.entry.Scope != m.scope {
+			continue
+		}
+		for _, zone := range []string{ir.ingressZone, ir.egressZone} {
+			if zone == `` || zones[zone] {
+				continue
+			}
+			switch {
+			case !configured:
+				findings = append(findings, Finding{
+					Source: ir.entry.Source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("interface rule matches zone %s without an inventory file"+
+						" and never applies", zone),
+				})
+			case inv != nil:
+				findings = append(findings, Finding{
+					Source: ir.entry.Source,
+					Level:  LevelWarning,
+					Message: fmt.Sprintf("interface rule matches zone %s, which no interface of the"+
+						" inventory belongs to, and never applies", zone),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// prefixLen returns the prefix length of n
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func inList(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSource splits a file:line source into file and line
+func splitSource(source string) (string, int) {
+	i := strings.LastIndex(source, `:`)
+	if i < 0 {
+		return source, 0
+	}
+	line, err := strconv.Atoi(source[i+1:])
+	if err != nil {
+		return source, 0
+	}
+	return source[:i], line
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
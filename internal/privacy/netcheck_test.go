@@ -0,0 +1,130 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// expectFindings compares findings with want, which lists the expected
+// findings by the suffix of their source, level and part of their
+// message
+func expectFindings(t *testing.T, findings []Finding, want [][3]string) {
+	t.Helper()
+	if len(findings) != len(want) {
+		t.Errorf("%d findings, want %d", len(findings), len(want))
+	}
+	for i := range want {
+		if i >= len(findings) {
+			t.Errorf("missing finding %s", want[i])
+			continue
+		}
+		f := findings[i]
+		if !strings.HasSuffix(f.Source, want[i][0]) || f.Level != want[i][1] ||
+			!strings.Contains(f.Message, want[i][2]) {
+			t.Errorf("finding %q, want %s", f, want[i])
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`policy.json`: `{"networks": [
+		{"prefix": "10.0.0.0/8", "class": "partner", "priority": 10},
+		{"prefix": "10.1.0.0/16", "class": "infrastructure"},
+		{"prefix": "192.0.2.0/24", "class": "partner"},
+		{"prefix": "192.0.2.0/24", "class": "infrastructure"},
+		{"prefix": "198.51.100.0/24", "class": "partner"},
+		{"prefix": "198.51.100.128/25", "class": "discard"},
+		{"prefix": "203.0.113.0/24", "class": "infrastructure"},
+		{"prefix": "203.0.113.0/25", "class": "infrastructure"},
+		{"prefix": "203.0.113.128/25", "class": "infrastructure", "labels": ["lab"]},
+		{"prefix": "172.16.0.0/33", "class": "partner"},
+		{"prefix": "172.17.0.0/16", "class": "lab"}
+		],
+		"interfaces": [
+		{"ingresszone": "vpn", "address": "src", "class": "employee-public"},
+		{"egresszone": "inside", "address": "dst", "class": "employee-private"}
+		],
+		"scopes": [{"name": "site-b", "agents": ["192.0.2.10"], "networks": [
+		{"prefix": "10.2.0.0/16", "class": "employee-private"},
+		{"prefix": "203.0.113.0/24", "class": "infrastructure", "priority": 1}
+		]}]}`,
+		`inventory.json`: `{"exporters": [{"addresses": ["192.0.2.20"],
+		 "interfaces": [{"index": 12, "zone": "inside"}]}]}`,
+	})
+
+	findings := CheckNetworks(NetworkConfig{
+		PolicyFile:    filepath.Join(dir, `policy.json`),
+		InventoryFile: filepath.Join(dir, `inventory.json`),
+	})
+	expectFindings(t, findings, [][3]string{
+		{`policy.json:3`, LevelWarning, `network 10.1.0.0/16 is shadowed by partner network 10.0.0.0/8`},
+		{`policy.json:5`, LevelWarning, `192.0.2.0/24 is also listed as partner at`},
+		{`policy.json:7`, LevelWarning, `discard network 198.51.100.128/25 overlaps partner network`},
+		{`policy.json:9`, LevelWarning, `network 203.0.113.0/25 is redundant, contained in 203.0.113.0/24`},
+		{`policy.json:11`, LevelError, `invalid CIDR address`},
+		{`policy.json:12`, LevelError, `unknown class lab`},
+		{`policy.json:15`, LevelWarning, `zone vpn, which no interface of the inventory belongs to`},
+		{`policy.json:19`, LevelWarning, `network 10.2.0.0/16 is shadowed by partner network 10.0.0.0/8`},
+	})
+
+	// without an inventory, zones never match
+	findings = CheckNetworks(NetworkConfig{PolicyFile: filepath.Join(dir, `policy.json`)})
+	n := 0
+	for _, f := range findings {
+		if strings.Contains(f.Message, `without an inventory file`) {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d interface rules reported without inventory, want 2", n)
+	}
+}
+
+func TestCheckLegacyNetworks(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`company-public.txt`:   "198.51.100.0/24\n",
+		`discard.txt`:          "192.0.2.0/24\n192.0.2.0/24\n",
+		`employee-private.txt`: "10.1.0.0/16\n172.16.0.0/16\n10.0.0.0/7\n",
+		`employee-public.txt`:  "203.0.113.0/24\n",
+		`reserved.txt`:         "10.0.0.0/8\n10.2.0.0/16\nnot-a-network\n",
+	})
+	expectFindings(t, CheckNetworks(NetworkConfig{Path: dir}), [][3]string{
+		{`discard.txt:2`, LevelWarning, `duplicate network 192.0.2.0/24`},
+		{`employee-private.txt:1`, LevelWarning, `network 10.1.0.0/16 is redundant, contained in 10.0.0.0/7`},
+		{`employee-private.txt:2`, LevelWarning, `not within any network of reserved.txt`},
+		{`employee-private.txt:3`, LevelWarning, `only partially within reserved.txt, only 10.0.0.0/8, 10.2.0.0/16`},
+		{`employee-public.txt:1`, LevelWarning, `not within any network of company-public.txt`},
+		{`reserved.txt:2`, LevelWarning, `network 10.2.0.0/16 is redundant, contained in 10.0.0.0/8`},
+		{`reserved.txt:3`, LevelError, `invalid CIDR address: not-a-network`},
+	})
+}
+
+func TestCheckVersions(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`a.json`: `{"networks": [{"prefix": "10.0.0.0/8", "class": "lab"}]}`,
+		`b.json`: `{"networks": []}`,
+		`inventory.json`: `{"exporters": [{"addresses": ["192.0.2.20"],
+		 "interfaces": [{"index": 12}, {"index": 12}]}]}`,
+		`versions.json`: `{"versions": [
+		{"id": "a", "effective": "2021-01-01T00:00:00Z", "policy": "a.json"},
+		{"id": "a", "effective": "2021-01-01T00:00:00Z", "policy": "b.json", "inventory": "inventory.json"}
+		]}`,
+	})
+	expectFindings(t, CheckNetworks(NetworkConfig{VersionsFile: filepath.Join(dir, `versions.json`)}), [][3]string{
+		{`a.json:1`, LevelError, `unknown class lab`},
+		{`inventory.json: exporter 1`, LevelError, `duplicate interface index 12`},
+		{`versions.json: version 2`, LevelError, `duplicate version a`},
+		{`versions.json: version 2`, LevelError, `effective at the same time as`},
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
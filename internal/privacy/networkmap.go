@@ -13,154 +13,580 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/mjolnir42/privprod/internal/flowdata"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
 )
 
-func buildNetworkMaps() {
-	cfgPath := os.Getenv(`PRIVACY_NETWORKFILE_PATH`)
-
-	employeePrivNetworks = map[string]*net.IPNet{}
-	employeePubNetworks = map[string]*net.IPNet{}
-	companyPubNetworks = map[string]*net.IPNet{}
-	reservedPrivNetworks = map[string]*net.IPNet{}
-	discardNetworks = map[string]*net.IPNet{}
-
-	for _, fname := range []string{
-		`company-public.txt`,
-		`discard.txt`,
-		`employee-private.txt`,
-		`employee-public.txt`,
-		`reserved.txt`,
-	} {
-		file, err := os.Open(filepath.Join(cfgPath, fname))
-		if err != nil {
-			logrus.Fatalln(err)
+// networkFiles lists the legacy network files read from
+// PRIVACY_NETWORKFILE_PATH, or imported by a policy file
+var networkFiles = []string{
+	`company-public.txt`,
+	`discard.txt`,
+	`employee-private.txt`,
+	`employee-public.txt`,
+	`reserved.txt`,
+}
+
+// Priorities of the policy entries imported from legacy network files.
+// Together with the intersection of the employee networks with the
+// reserved and company networks, they reproduce the classification of
+// the legacy network files.
+const (
+	legacyPriorityDiscard      = 100
+	legacyPriorityEmployeePriv = 20
+	legacyPriorityEmployeePub  = 10
+	legacyPriorityDefault      = 0
+)
+
+// networkMap is a fully parsed and immutable network policy. The
+// global network map contains one network map per scope, which
+// includes the global entries.
+type networkMap struct {
+	trie     *netTrie
+	fallback *policyEntry
+	count    int
+	// classes are shared by the global and all scoped network maps
+	classes map[string]*policyClass
+	// scope is the name of the scope, or empty for the global map
+	scope  string
+	scopes map[string]*networkMap
+	agents []agentScope
+	// rules are the interface rules, global rules first
+	rules []*interfaceRule
+	// inventory is shared by the global and all scoped network maps
+	inventory *inventory
+	// version identifies the network map, which is used for records
+	// starting at effective
+	version   string
+	effective time.Time
+}
+
+// agentScope assigns exporters to a scope
+type agentScope struct {
+	network *net.IPNet
+	scope   string
+}
+
+// fileStamp is used to detect changes to a network file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+var (
+	// reloadLock serializes network map reloads
+	reloadLock sync.Mutex
+	// reloadFiles are the files the last reload attempt read from
+	reloadFiles []string
+	// reloadStamps are the file stamps of the last reload attempt,
+	// successful or not
+	reloadStamps map[string]fileStamp
+)
+
+func newNetworkMap() *networkMap {
+	classes := builtinClasses()
+	return &networkMap{
+		trie:     newNetTrie(),
+		fallback: defaultEntry(classes),
+		classes:  classes,
+		scopes:   map[string]*networkMap{},
+	}
+}
+
+// newScope returns a new scoped network map, that includes all entries
+// of m added so far and inherits its default entry
+func (m *networkMap) newScope(name string) *networkMap {
+	sm := newNetworkMap()
+	sm.scope = name
+	sm.classes = m.classes
+	sm.fallback = m.fallback
+	m.trie.Walk(sm.trie.Insert)
+	sm.count = m.count
+	sm.rules = append(sm.rules, m.rules...)
+	m.scopes[name] = sm
+	return sm
+}
+
+// addAgent assigns the exporters matching agent, an address or a
+// network, to scope
+func (m *networkMap) addAgent(agent, scope string) error {
+	ipnet, err := parseAgent(agent)
+	if err != nil {
+		return err
+	}
+	for _, a := range m.agents {
+		if a.network.String() == ipnet.String() {
+			return fmt.Errorf("agent %s is already assigned to scope %s",
+				agent, a.scope)
 		}
-		defer file.Close()
+	}
+	m.agents = append(m.agents, agentScope{network: ipnet, scope: scope})
+	return nil
+}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, `#`) {
-				// ignore comment
-				continue
-			}
-			line = strings.TrimSpace(line)
-
-			var nmap *map[string]*net.IPNet
-			var err error
-
-			switch fname {
-			case `company-public.txt`:
-				nmap = &companyPubNetworks
-			case `discard.txt`:
-				nmap = &discardNetworks
-			case `employee-private.txt`:
-				nmap = &employeePrivNetworks
-			case `employee-public.txt`:
-				nmap = &employeePubNetworks
-			case `reserved.txt`:
-				nmap = &reservedPrivNetworks
-			}
-			if _, (*nmap)[line], err = net.ParseCIDR(line); err != nil {
-				logrus.Fatalln(err)
-			}
+// parseAgent parses an exporter address or network
+func parseAgent(agent string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(agent); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(agent)
+	switch {
+	case ip == nil:
+		return nil, fmt.Errorf("invalid agent address: %s", agent)
+	case ip.To4() != nil:
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// forAgent returns the network map for exporter agentID. The most
+// specific agent network wins, exporters without a scope use the
+// global network map.
+func (m *networkMap) forAgent(agentID string) *networkMap {
+	ip := net.ParseIP(agentID)
+	if ip == nil || len(m.agents) == 0 {
+		return m
+	}
+	res, best := m, -1
+	for _, a := range m.agents {
+		if l := prefixLen(a.network); l > best && a.network.Contains(ip) {
+			res, best = m.scopes[a.scope], l
 		}
+	}
+	return res
+}
+
+// add inserts policy entry e into the network map
+func (m *networkMap) add(e *policyEntry) {
+	e.order = m.count
+	m.count++
+	m.trie.Insert(e)
+}
 
-		if err := scanner.Err(); err != nil {
-			logrus.Fatalln(err)
+// lookup returns the policy entry that applies to ip. For addresses
+// with an embedded IPv4 address, the entry of the embedded address
+// applies unless an entry more specific than the transition prefix
+// matches ip.
+func (m *networkMap) lookup(ip net.IP) *policyEntry {
+	e := m.trie.Lookup(ip)
+	if v4, t := embeddedIPv4(ip); v4 != nil &&
+		(e == nil || prefixLen(e.Network) <= prefixLen(t.network)) {
+		if e4 := m.trie.Lookup(v4); e4 != nil {
+			return e4
 		}
 	}
+	if e != nil {
+		return e
+	}
+	return m.fallback
 }
 
-func discard(ip net.IP) bool {
-	for i := range discardNetworks {
-		if discardNetworks[i].Contains(ip) {
-			return true
+// networkMaps returns the currently active network map store.
+// Callers must fetch it once per record, so that both addresses of a
+// record are classified with the same version.
+func networkMaps() *networkStore {
+	s, _ := activeNetworks.Load().(*networkStore)
+	return s
+}
+
+// ReloadNetworkMaps loads the network maps configured by the
+// environment, see NetworkConfigFromEnv, and activates them for all
+// handlers. If a file can not be read or parsed, the previously active
+// network maps stay in use and the error is returned. It must be
+// called successfully once before the first Protector is started.
+func ReloadNetworkMaps() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	s, files, source, err := loadNetworkStore(NetworkConfigFromEnv())
+	reloadFiles = files
+	reloadStamps = statFiles(files)
+	if err != nil {
+		return err
+	}
+
+	old := networkMaps()
+	activeNetworks.Store(s)
+
+	m := s.current()
+	if old == nil {
+		logrus.Infof("Privacy: loaded %d networks from %s, version %s of %d\n",
+			m.trie.Len(), source, m.version, len(s.versions))
+		if m.inventory != nil {
+			logrus.Infof("Privacy: loaded inventory of %d exporters\n",
+				m.inventory.count)
 		}
+		return nil
 	}
-	return false
+	logReloadSummary(old.current(), m)
+	return nil
 }
 
-func isPrivate(ip net.IP) bool {
-	for i := range reservedPrivNetworks {
-		if reservedPrivNetworks[i].Contains(ip) {
+// LoadNetworkMaps activates the network maps of cfg without tracking
+// them for changes. It is used by commands that classify addresses
+// outside of the daemon.
+func LoadNetworkMaps(cfg NetworkConfig) error {
+	s, _, _, err := loadNetworkStore(cfg)
+	if err != nil {
+		return err
+	}
+	activeNetworks.Store(s)
+	return nil
+}
+
+// loadNetworkMaps reads the policy file policyFile, or the legacy
+// network files within cfgPath if policyFile is empty, and the
+// inventory file inventoryFile if set. It returns the network map, the
+// files it was read from and a description of the source.
+func loadNetworkMaps(policyFile, cfgPath, inventoryFile string) (*networkMap, []string, string, error) {
+	m, files, source, err := loadNetworks(policyFile, cfgPath)
+	if inventoryFile == `` {
+		return m, files, source, err
+	}
+	files = append(files, inventoryFile)
+	if err != nil {
+		return nil, files, source, err
+	}
+	inv, err := loadInventory(inventoryFile)
+	if err != nil {
+		return nil, files, source, err
+	}
+	m.inventory = inv
+	for _, sm := range m.scopes {
+		sm.inventory = inv
+	}
+	return m, files, source, nil
+}
+
+// loadNetworks reads the policy file policyFile, or the legacy network
+// files within cfgPath if policyFile is empty
+func loadNetworks(policyFile, cfgPath string) (*networkMap, []string, string, error) {
+	if policyFile != `` {
+		m, files, err := loadPolicyFile(policyFile)
+		return m, files, policyFile, err
+	}
+
+	files := legacyNetworkFiles(cfgPath)
+	registry, err := legacyRegistry()
+	if err != nil {
+		return nil, files, cfgPath, err
+	}
+	legacy, err := readLegacyNetworks(cfgPath)
+	if err != nil {
+		return nil, files, cfgPath, err
+	}
+	m := newNetworkMap()
+	legacy.importInto(m, ``)
+	if registry {
+		m.addRegistry()
+	}
+	return m, files, cfgPath, nil
+}
+
+// NetworkMapsChanged reports if any network or policy file has been
+// modified since the last reload attempt
+func NetworkMapsChanged() bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	current := statFiles(reloadFiles)
+	if len(current) != len(reloadStamps) {
+		return true
+	}
+	for fname, stamp := range current {
+		prev, ok := reloadStamps[fname]
+		if !ok || !prev.modTime.Equal(stamp.modTime) || prev.size != stamp.size {
 			return true
 		}
 	}
 	return false
 }
 
-func isEmployeePriv(ip net.IP) bool {
-	for i := range employeePrivNetworks {
-		if employeePrivNetworks[i].Contains(ip) {
-			return true
+// statFiles returns the current stamps of all files that exist
+func statFiles(files []string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, fname := range files {
+		fi, err := os.Stat(fname)
+		if err != nil {
+			continue
 		}
+		stamps[fname] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
 	}
-	return false
+	return stamps
 }
 
-func isEmployeePub(ip net.IP) bool {
-	for i := range employeePubNetworks {
-		if employeePubNetworks[i].Contains(ip) {
-			return true
+// legacyNetworkFiles returns the paths of the legacy network files
+// within cfgPath
+func legacyNetworkFiles(cfgPath string) []string {
+	files := make([]string, 0, len(networkFiles))
+	for _, fname := range networkFiles {
+		files = append(files, filepath.Join(cfgPath, fname))
+	}
+	return files
+}
+
+// legacyNetwork is a network read from a legacy network file
+type legacyNetwork struct {
+	network *net.IPNet
+	source  string
+}
+
+// legacyNetworks contains the networks read from the legacy network
+// files, by file name
+type legacyNetworks map[string][]legacyNetwork
+
+// readLegacyNetworks parses all legacy network files within cfgPath
+func readLegacyNetworks(cfgPath string) (legacyNetworks, error) {
+	l, errs := parseLegacyNetworks(cfgPath)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return l, nil
+}
+
+// parseLegacyNetworks parses all legacy network files within cfgPath
+// and returns all networks that could be parsed together with all
+// encountered errors
+func parseLegacyNetworks(cfgPath string) (legacyNetworks, []error) {
+	l := legacyNetworks{}
+	errs := []error{}
+	for _, fname := range networkFiles {
+		errs = append(errs, l.readFile(cfgPath, fname)...)
+	}
+	return l, errs
+}
+
+// readFile reads all networks from legacy network file fname. Empty
+// lines and everything following a # are ignored.
+func (l legacyNetworks) readFile(cfgPath, fname string) []error {
+	path := filepath.Join(cfgPath, fname)
+	file, err := os.Open(path)
+	if err != nil {
+		return []error{err}
+	}
+	defer file.Close()
+
+	errs := []error{}
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, `#`); i >= 0 {
+			// ignore comment
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == `` {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			errs = append(errs, errAt(fmt.Sprintf("%s:%d", path, lineNo), err.Error()))
+			continue
 		}
+		l[fname] = append(l[fname], legacyNetwork{
+			network: ipnet,
+			source:  fmt.Sprintf("%s:%d", path, lineNo),
+		})
 	}
-	return false
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, errAt(path, err.Error()))
+	}
+	return errs
 }
 
-func isPublic(ip net.IP) bool {
-	if !isPrivate(ip) && !isCompany(ip) {
-		return true
+// importInto adds the legacy networks as policy entries of scope to m.
+// Employee networks are only effective within reserved respectively
+// company networks, so only their intersections are imported. The
+// remaining reserved and company networks are infrastructure.
+func (l legacyNetworks) importInto(m *networkMap, scope string) {
+	entry := func(n *net.IPNet, class string, priority int, source string) *policyEntry {
+		return &policyEntry{
+			Network:  n,
+			Class:    class,
+			Actions:  m.classes[class].Actions,
+			Priority: priority,
+			class:    m.classes[class],
+			Scope:    scope,
+			Source:   source,
+			imported: true,
+		}
+	}
+
+	for _, ln := range l[`discard.txt`] {
+		m.add(entry(ln.network, classDiscard, legacyPriorityDiscard, ln.source))
+	}
+
+	for _, imp := range []struct {
+		fname, within, class string
+		priority             int
+	}{
+		{`employee-private.txt`, `reserved.txt`, classEmployeePriv, legacyPriorityEmployeePriv},
+		{`employee-public.txt`, `company-public.txt`, classEmployeePub, legacyPriorityEmployeePub},
+	} {
+		seen := map[string]bool{}
+		for _, ln := range l[imp.fname] {
+			for _, outer := range l[imp.within] {
+				n := intersect(ln.network, outer.network)
+				if n == nil || seen[n.String()] {
+					continue
+				}
+				seen[n.String()] = true
+				m.add(entry(n, imp.class, imp.priority, ln.source))
+			}
+		}
+	}
+
+	for _, fname := range []string{`reserved.txt`, `company-public.txt`} {
+		for _, ln := range l[fname] {
+			m.add(entry(ln.network, classInfrastructure, legacyPriorityDefault, ln.source))
+		}
 	}
-	return false
 }
 
-func isCompany(ip net.IP) bool {
-	for i := range companyPubNetworks {
-		if companyPubNetworks[i].Contains(ip) {
-			return true
+// intersect returns the intersection of networks a and b. Since
+// networks are either nested or disjoint, this is either the more
+// specific of both networks or nil.
+func intersect(a, b *net.IPNet) *net.IPNet {
+	al, abits := a.Mask.Size()
+	bl, bbits := b.Mask.Size()
+	switch {
+	case abits != bbits:
+		return nil
+	case al >= bl && b.Contains(a.IP):
+		return a
+	case bl >= al && a.Contains(b.IP):
+		return b
+	}
+	return nil
+}
+
+// entryKey identifies a policy entry when comparing two network maps
+func entryKey(e *policyEntry) string {
+	return fmt.Sprintf("%s [%s] %s",
+		e.Network.String(), e.Actions.String(), strings.Join(e.Labels, `,`))
+}
+
+// entriesByClass returns the keys of all policy entries by class.
+// Classes of scoped entries are prefixed with the scope name.
+func (m *networkMap) entriesByClass() map[string]map[string]bool {
+	res := map[string]map[string]bool{}
+	collect := func(scope string) func(*policyEntry) {
+		return func(e *policyEntry) {
+			if e.Scope != scope {
+				return
+			}
+			class := e.Class
+			if scope != `` {
+				class = scope + `/` + e.Class
+			}
+			if res[class] == nil {
+				res[class] = map[string]bool{}
+			}
+			res[class][entryKey(e)] = true
 		}
 	}
-	return false
+	m.trie.Walk(collect(``))
+	for name, sm := range m.scopes {
+		sm.trie.Walk(collect(name))
+	}
+	return res
 }
 
-func fmtEmployeePriv(b []byte) string {
-	return fmt.Sprintf(
-		"0100:a000:%x:%x:%x:%x:%x:%x",
-		b[4:6],
-		b[6:8],
-		b[8:10],
-		b[10:12],
-		b[12:14],
-		b[14:16],
-	)
-}
-
-func fmtEmployeePub(b []byte) string {
-	return fmt.Sprintf(
-		"0100:b000:%x:%x:%x:%x:%x:%x",
-		b[4:6],
-		b[6:8],
-		b[8:10],
-		b[10:12],
-		b[12:14],
-		b[14:16],
-	)
-}
-
-func fmtCustomer(b []byte) string {
-	return fmt.Sprintf(
-		"0100:c000:%x:%x:%x:%x:%x:%x",
-		b[4:6],
-		b[6:8],
-		b[8:10],
-		b[10:12],
-		b[12:14],
-		b[14:16],
-	)
+// logReloadSummary logs the networks that have been added or removed
+// per class between old and new
+func logReloadSummary(old, new *networkMap) {
+	before := old.entriesByClass()
+	after := new.entriesByClass()
+
+	classes := []string{}
+	for class := range before {
+		classes = append(classes, class)
+	}
+	for class := range after {
+		if _, ok := before[class]; !ok {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+
+	for _, class := range classes {
+		added := []string{}
+		removed := []string{}
+		for key := range after[class] {
+			if !before[class][key] {
+				added = append(added, key)
+			}
+		}
+		for key := range before[class] {
+			if !after[class][key] {
+				removed = append(removed, key)
+			}
+		}
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+
+		logrus.Infof("Privacy: reloaded class %s: %d added, %d removed\n",
+			class, len(added), len(removed))
+		for _, key := range added {
+			logrus.Infof("Privacy: %s: added %s\n", class, key)
+		}
+		for _, key := range removed {
+			logrus.Infof("Privacy: %s: removed %s\n", class, key)
+		}
+	}
+	logrus.Infof("Privacy: activated network maps version %s with %d networks\n",
+		new.version, new.trie.Len())
+}
+
+// pseudonymize returns the pseudonym of ip for class c made with key k,
+// and the prefix length at which it was pseudonymized. All addresses
+// within a prefix of that length share the pseudonym. Addresses with an
+// embedded IPv4 address are pseudonymized as the embedded address, IPv4
+// pseudonyms are embedded into the bare transition prefix again.
+func pseudonymize(ip net.IP, c *policyClass, k *pseudonymKey) (string, int) {
+	if v4, t := embeddedIPv4(ip); v4 != nil {
+		p, plen := pseudonymize(v4.To16(), c, k)
+		if pip := net.ParseIP(p).To4(); pip != nil {
+			return t.embed(t.network.IP, pip).String(), plen
+		}
+		return p, plen
+	}
+	plen, bits := c.granularity(ip)
+	mask := net.CIDRMask(plen, bits)
+	if plen < bits {
+		ip = ip.Mask(mask).To16()
+	}
+	if c.Mode == modePrefixPreserving {
+		return k.pan.anonymize(ip).Mask(mask).String(), plen
+	}
+	hash, _ := blake2b.New256(k.key)
+	hash.Write(dataPad)
+	hash.Write([]byte(ip))
+	if c.Range4 != nil && ip.To4() != nil {
+		return c.formatIPv4(hash.Sum(nil)), plen
+	}
+	return c.format(hash.Sum(nil)), plen
+}
+
+// formatAddress formats address addr, cleartext or pseudonym, in the
+// configured address format
+func formatAddress(addr string) string {
+	if addressFormat == formatNative {
+		return flowdata.FormatIPNative(addr)
+	}
+	return flowdata.FormatIP(addr)
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
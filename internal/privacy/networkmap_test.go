@@ -0,0 +1,206 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestScopedNetworks(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{
+	  "networks": [
+	    {"prefix": "10.20.0.0/16", "class": "partner", "priority": 5},
+	    {"prefix": "10.30.0.0/16", "class": "partner"}
+	  ],
+	  "scopes": [
+	    {"name": "site-b", "agents": ["192.0.2.10", "192.0.2.64/27"],
+	     "default": {"class": "employee-public"},
+	     "networks": [
+	      {"prefix": "10.20.0.0/16", "class": "infrastructure", "priority": 5},
+	      {"prefix": "10.30.0.0/16", "class": "infrastructure", "priority": -1}
+	    ]},
+	    {"name": "site-c", "agents": ["192.0.2.64/28"], "networks": [
+	      {"prefix": "10.20.0.0/16", "class": "employee-private", "priority": 5}
+	    ]}
+	  ]
+	}`})
+	m, _, err := loadPolicyFile(filepath.Join(dir, `policy.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		agent, ip, class string
+	}{
+		// the scoped entry overrides the global entry of the same
+		// prefix and priority
+		{`192.0.2.10`, `10.20.1.1`, classInfrastructure},
+		{`192.0.2.80`, `10.20.1.1`, classInfrastructure},
+		// the most specific agent network selects the scope
+		{`192.0.2.70`, `10.20.1.1`, classEmployeePriv},
+		// but not one of a lower priority
+		{`192.0.2.10`, `10.30.1.1`, classPartner},
+		// the scope default only applies within the scope
+		{`192.0.2.10`, `8.8.8.8`, classEmployeePub},
+		{`192.0.2.70`, `8.8.8.8`, classCustomer},
+		// other exporters and invalid agent IDs use the global entries
+		{`192.0.2.11`, `10.20.1.1`, classPartner},
+		{`192.0.2.11`, `8.8.8.8`, classCustomer},
+		{``, `10.20.1.1`, classPartner},
+		{`exporter`, `10.20.1.1`, classPartner},
+	} {
+		e := m.forAgent(c.agent).lookup(net.ParseIP(c.ip))
+		if e.Class != c.class {
+			t.Errorf("%s via %q: classified as %s by %s, want %s",
+				c.ip, c.agent, e.Class, e.Source, c.class)
+		}
+	}
+	if e := m.lookup(net.ParseIP(`10.20.1.1`)); e.Scope != `` {
+		t.Errorf("global network map uses entry of scope %s", e.Scope)
+	}
+}
+
+// reloadFromPolicy configures ReloadNetworkMaps to read the policy
+// file fname until the end of the test
+func reloadFromPolicy(t *testing.T, fname string) {
+	t.Helper()
+	for env, value := range map[string]string{
+		`PRIVACY_NETWORKMAP_VERSIONS`: ``,
+		`PRIVACY_POLICY_FILE`:         fname,
+		`PRIVACY_NETWORKFILE_PATH`:    ``,
+		`PRIVACY_INVENTORY_FILE`:      ``,
+	} {
+		env := env
+		if prev, ok := os.LookupEnv(env); ok {
+			t.Cleanup(func() { os.Setenv(env, prev) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(env) })
+		}
+		os.Setenv(env, value)
+	}
+	if prev := activeNetworks.Load(); prev != nil {
+		t.Cleanup(func() { activeNetworks.Store(prev) })
+	}
+}
+
+func TestReloadKeepsNetworkMap(t *testing.T) {
+	dir := writeTestFiles(t, nil)
+	fname := filepath.Join(dir, `policy.json`)
+	write := func(data string) {
+		if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloadFromPolicy(t, fname)
+	ip := net.ParseIP(`10.1.2.3`)
+	classOf := func() string {
+		return networkMaps().current().lookup(ip).Class
+	}
+
+	write(`{"networks": [{"prefix": "10.0.0.0/8", "class": "partner"}]}`)
+	if err := ReloadNetworkMaps(); err != nil {
+		t.Fatal(err)
+	}
+	if c := classOf(); c != classPartner {
+		t.Fatalf("classified as %s, want %s", c, classPartner)
+	}
+
+	for _, bad := range []string{
+		`{"networks": [{"prefix": "10.0.0.0/8", "class": "infrastructure"}`,
+		`{"networks": [{"prefix": "10.0.0.0/8", "class": "lab"}]}`,
+		``,
+	} {
+		if bad == `` {
+			os.Remove(fname)
+		} else {
+			write(bad)
+		}
+		if !NetworkMapsChanged() {
+			t.Errorf("change not detected")
+		}
+		if err := ReloadNetworkMaps(); err == nil {
+			t.Errorf("invalid policy file %q activated", bad)
+		}
+		if c := classOf(); c != classPartner {
+			t.Errorf("failed reload replaced the network map, classified as %s", c)
+		}
+		// the failed attempt is not retried until the files change
+		if NetworkMapsChanged() {
+			t.Errorf("failed reload reported as change")
+		}
+	}
+
+	write(`{"networks": [{"prefix": "10.0.0.0/8", "class": "infrastructure"}]}`)
+	if err := ReloadNetworkMaps(); err != nil {
+		t.Fatal(err)
+	}
+	if c := classOf(); c != classInfrastructure {
+		t.Errorf("classified as %s after reload, want %s", c, classInfrastructure)
+	}
+}
+
+// TestReloadConcurrentLookup swaps the network maps while they are
+// used, it is meant to be run with -race
+func TestReloadConcurrentLookup(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`a.json`: `{"networks": [{"prefix": "10.0.0.0/8", "class": "partner"}]}`,
+		`b.json`: `{"networks": [{"prefix": "10.0.0.0/8", "class": "infrastructure"},
+		  {"prefix": "10.1.0.0/16", "class": "infrastructure"}]}`,
+	})
+	reloadFromPolicy(t, filepath.Join(dir, `a.json`))
+	if err := ReloadNetworkMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan string, 4)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src, dst := net.ParseIP(`10.1.2.3`), net.ParseIP(`10.9.9.9`)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// both addresses of a record use the same version
+				m := networkMaps().current()
+				s, d := m.lookup(src), m.lookup(dst)
+				if s.Class != d.Class || (s.Class != classPartner && s.Class != classInfrastructure) {
+					errs <- s.Class + ` ` + d.Class
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		fname := filepath.Join(dir, []string{`a.json`, `b.json`}[i%2])
+		if err := os.Setenv(`PRIVACY_POLICY_FILE`, fname); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReloadNetworkMaps(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Errorf("inconsistent classification during reload: %s", e)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
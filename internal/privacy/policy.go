@@ -0,0 +1,458 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// actionSet is a bitmask of the actions applied to an address
+type actionSet uint8
+
+const (
+	actDiscard actionSet = 1 << iota
+	actPseudonymize
+	actEncrypt
+	actIOC
+	actPass
+)
+
+var actionNames = []struct {
+	name   string
+	action actionSet
+}{
+	{`discard`, actDiscard},
+	{`pseudonymize`, actPseudonymize},
+	{`encrypt`, actEncrypt},
+	{`ioc`, actIOC},
+	{`pass`, actPass},
+}
+
+// has reports if all actions of flag are set in a
+func (a actionSet) has(flag actionSet) bool {
+	return a&flag == flag
+}
+
+func (a actionSet) String() string {
+	names := []string{}
+	for _, an := range actionNames {
+		if a.has(an.action) {
+			names = append(names, an.name)
+		}
+	}
+	return strings.Join(names, `,`)
+}
+
+// parseActions converts a list of action names into an actionSet and
+// validates the combination
+func parseActions(names []string) (actionSet, error) {
+	var a actionSet
+names:
+	for _, name := range names {
+		for _, an := range actionNames {
+			if an.name == name {
+				a |= an.action
+				continue names
+			}
+		}
+		return 0, fmt.Errorf("unknown action: %s", name)
+	}
+	switch {
+	case a == 0:
+		return 0, fmt.Errorf("no actions configured")
+	case a.has(actDiscard) && a != actDiscard:
+		return 0, fmt.Errorf("action discard can not be combined with other actions")
+	case a.has(actPass) && a != actPass:
+		return 0, fmt.Errorf("action pass can not be combined with other actions")
+	}
+	return a, nil
+}
+
+// sourceError is an error at a specific location of a network or
+// policy file
+type sourceError struct {
+	source string
+	msg    string
+}
+
+func (e *sourceError) Error() string {
+	return e.source + `: ` + e.msg
+}
+
+func errAt(source, msg string) error {
+	return &sourceError{source: source, msg: msg}
+}
+
+// policyEntry is a network prefix with its classification and the
+// actions to apply to addresses within it
+type policyEntry struct {
+	Network  *net.IPNet
+	Class    string
+	Labels   []string
+	Actions  actionSet
+	Priority int
+	// class is the definition of Class
+	class *policyClass
+	// Scope is the name of the exporter group the entry is limited
+	// to, or empty for global entries
+	Scope string
+	// Source describes where the entry was defined
+	Source string
+	// order is the position in which the entry was defined
+	order int
+	// imported is set for entries converted from legacy network files
+	imported bool
+	// builtin is set for entries of the special-purpose registry
+	builtin bool
+}
+
+// precedes reports if e takes precedence over o. Entries of the
+// special-purpose registry are only compared among themselves, see
+// yields.
+func (e *policyEntry) precedes(o *policyEntry) bool {
+	el, _ := e.Network.Mask.Size()
+	ol, _ := o.Network.Mask.Size()
+	if e.Priority != o.Priority {
+		return e.Priority > o.Priority
+	}
+	if el != ol {
+		return el > ol
+	}
+	if (e.Scope == ``) != (o.Scope == ``) {
+		return e.Scope != ``
+	}
+	return e.order < o.order
+}
+
+// yields reports if the special-purpose registry entry r replaces e,
+// the winning configured entry. Configured entries of the same or a
+// longer prefix, or of a higher priority, keep precedence.
+func (e *policyEntry) yields(r *policyEntry) bool {
+	return prefixLen(e.Network) < prefixLen(r.Network) && e.Priority <= r.Priority
+}
+
+// validate checks the entry for consistency and resolves its class
+// within classes. Entries without actions use those of their class.
+func (e *policyEntry) validate(classes map[string]*policyClass) error {
+	c, ok := classes[e.Class]
+	switch {
+	case e.Class == ``:
+		return errAt(e.Source, `no class configured`)
+	case !ok:
+		return errAt(e.Source, fmt.Sprintf("unknown class %s", e.Class))
+	}
+	e.class = c
+	if e.Actions == 0 {
+		e.Actions = c.Actions
+	}
+	if c.Name == classSpecialPurpose && e.Actions.has(actIOC) {
+		return errAt(e.Source, fmt.Sprintf(
+			"class %s does not support action ioc", e.Class))
+	}
+	if e.Actions.has(actPseudonymize) && !c.pseudonymizes() {
+		return errAt(e.Source, fmt.Sprintf(
+			"class %s does not support pseudonymization", e.Class))
+	}
+	return nil
+}
+
+// policyFile is the JSON representation of a policy file, its format
+// is described in README.md
+type policyFile struct {
+	// Import is a directory with network files in the legacy
+	// format, relative to the policy file
+	Import string `json:"import,omitempty"`
+	// Registry disables the builtin special-purpose registry if
+	// set to false
+	Registry   *bool             `json:"registry,omitempty"`
+	Classes    []json.RawMessage `json:"classes,omitempty"`
+	Default    *policyFileEntry  `json:"default,omitempty"`
+	Networks   []json.RawMessage `json:"networks"`
+	Interfaces []json.RawMessage `json:"interfaces,omitempty"`
+	Scopes     []json.RawMessage `json:"scopes,omitempty"`
+}
+
+type policyFileEntry struct {
+	Prefix   string   `json:"prefix,omitempty"`
+	Class    string   `json:"class"`
+	Labels   []string `json:"labels,omitempty"`
+	Actions  []string `json:"actions,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+}
+
+// policyFileScope is a group of exporters with additional networks,
+// that take precedence over the global networks of the policy
+type policyFileScope struct {
+	Name       string            `json:"name"`
+	Agents     []string          `json:"agents"`
+	Import     string            `json:"import,omitempty"`
+	Default    *policyFileEntry  `json:"default,omitempty"`
+	Networks   []json.RawMessage `json:"networks"`
+	Interfaces []json.RawMessage `json:"interfaces,omitempty"`
+}
+
+// defaultEntry is applied to addresses that match no policy entry
+func defaultEntry(classes map[string]*policyClass) *policyEntry {
+	return &policyEntry{
+		Class:   classCustomer,
+		Actions: classes[classCustomer].Actions,
+		Source:  `builtin default`,
+		class:   classes[classCustomer],
+	}
+}
+
+// loadPolicyFile parses the policy file fname into a new networkMap.
+// It returns the network map and the list of all files it was built
+// from.
+func loadPolicyFile(fname string) (*networkMap, []string, error) {
+	m, files, _, errs := parsePolicyFile(fname)
+	if len(errs) > 0 {
+		return nil, files, errs[0]
+	}
+	return m, files, nil
+}
+
+// policyParser holds the state while parsing a policy file
+type policyParser struct {
+	fname  string
+	data   []byte
+	files  []string
+	legacy []legacyNetworks
+	errs   []error
+}
+
+// parsePolicyFile parses the policy file fname. It returns a network
+// map with all entries that could be parsed, the list of files it was
+// built from, the imported legacy networks and all encountered errors.
+func parsePolicyFile(fname string) (*networkMap, []string, []legacyNetworks, []error) {
+	pp := &policyParser{
+		fname: fname,
+		files: []string{fname},
+		errs:  []error{},
+	}
+
+	var err error
+	if pp.data, err = ioutil.ReadFile(fname); err != nil {
+		return nil, pp.files, nil, []error{err}
+	}
+
+	pf := policyFile{}
+	decoder := json.NewDecoder(bytes.NewReader(pp.data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&pf); err != nil {
+		return nil, pp.files, nil, []error{jsonError(fname, pp.data, err)}
+	}
+	// locate the raw network list to report the line numbers of its
+	// entries
+	raw := map[string]json.RawMessage{}
+	json.Unmarshal(pp.data, &raw)
+
+	m := newNetworkMap()
+	pp.parseClasses(m, pf.Classes, pp.offset(0, raw[`classes`]))
+	pp.parseDefault(m, pf.Default, fmt.Sprintf("%s: default", fname))
+	pp.parseNetworks(m, ``, pf.Networks, pp.offset(0, raw[`networks`]))
+	if pf.Import != `` {
+		pp.importLegacy(m, ``, pf.Import)
+	}
+	if pf.Registry == nil || *pf.Registry {
+		m.addRegistry()
+	}
+	pp.parseInterfaces(m, ``, pf.Interfaces, pp.offset(0, raw[`interfaces`]))
+
+	offset := 0
+	for i := range pf.Scopes {
+		start := pp.offset(offset, pf.Scopes[i])
+		offset = start + len(pf.Scopes[i])
+		pp.parseScope(m, pf.Scopes[i], start)
+	}
+	return m, pp.files, pp.legacy, pp.errs
+}
+
+// offset returns the position of raw within the policy file, searching
+// from position from onwards. Raw messages are verbatim copies of the
+// input.
+func (pp *policyParser) offset(from int, raw []byte) int {
+	if len(raw) == 0 || from > len(pp.data) {
+		return from
+	}
+	if pos := bytes.Index(pp.data[from:], raw); pos >= 0 {
+		return from + pos
+	}
+	return from
+}
+
+// source returns the file:line location of offset
+func (pp *policyParser) source(offset int) string {
+	return fmt.Sprintf("%s:%d", pp.fname,
+		bytes.Count(pp.data[:offset], []byte{'\n'})+1)
+}
+
+// parseClasses adds the class definitions raws to m. They are searched
+// within the policy file from position base onwards.
+func (pp *policyParser) parseClasses(m *networkMap, raws []json.RawMessage, base int) {
+	offset := base
+	for i := range raws {
+		start := pp.offset(offset, raws[i])
+		offset = start + len(raws[i])
+		source := pp.source(start)
+
+		pfc := policyFileClass{}
+		decoder := json.NewDecoder(bytes.NewReader(raws[i]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&pfc); err != nil {
+			pp.errs = append(pp.errs, errAt(source, err.Error()))
+			continue
+		}
+		if err := pfc.define(m.classes, source); err != nil {
+			pp.errs = append(pp.errs, err)
+		}
+	}
+	pp.errs = append(pp.errs, checkClasses(m.classes)...)
+	m.fallback = defaultEntry(m.classes)
+}
+
+// parseDefault sets the default entry of m from pfe, if configured
+func (pp *policyParser) parseDefault(m *networkMap, pfe *policyFileEntry, source string) {
+	if pfe == nil {
+		return
+	}
+	e, err := pfe.entry(source, m.classes)
+	switch {
+	case err != nil:
+		pp.errs = append(pp.errs, err)
+	case pfe.Prefix != ``:
+		pp.errs = append(pp.errs, errAt(source, `prefix not allowed`))
+	default:
+		e.Scope = m.scope
+		m.fallback = e
+	}
+}
+
+// parseNetworks adds the network entries raws to m. They are searched
+// within the policy file from position base onwards.
+func (pp *policyParser) parseNetworks(m *networkMap, scope string, raws []json.RawMessage, base int) {
+	offset := base
+	for i := range raws {
+		start := pp.offset(offset, raws[i])
+		offset = start + len(raws[i])
+		source := pp.source(start)
+
+		pfe := policyFileEntry{}
+		decoder := json.NewDecoder(bytes.NewReader(raws[i]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&pfe); err != nil {
+			pp.errs = append(pp.errs, errAt(source, err.Error()))
+			continue
+		}
+		e, err := pfe.entry(source, m.classes)
+		if err != nil {
+			pp.errs = append(pp.errs, err)
+			continue
+		}
+		if _, e.Network, err = net.ParseCIDR(pfe.Prefix); err != nil {
+			pp.errs = append(pp.errs, errAt(source, err.Error()))
+			continue
+		}
+		e.Scope = scope
+		m.add(e)
+	}
+}
+
+// importLegacy imports the legacy network files within dir into m
+func (pp *policyParser) importLegacy(m *networkMap, scope, dir string) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(pp.fname), dir)
+	}
+	pp.files = append(pp.files, legacyNetworkFiles(dir)...)
+	legacy, errs := parseLegacyNetworks(dir)
+	pp.errs = append(pp.errs, errs...)
+	pp.legacy = append(pp.legacy, legacy)
+	legacy.importInto(m, scope)
+}
+
+// parseScope adds the scope raw, found at position base of the policy
+// file, to m
+func (pp *policyParser) parseScope(m *networkMap, raw []byte, base int) {
+	source := pp.source(base)
+	pfs := policyFileScope{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&pfs); err != nil {
+		pp.errs = append(pp.errs, errAt(source, err.Error()))
+		return
+	}
+
+	switch {
+	case pfs.Name == ``:
+		pp.errs = append(pp.errs, errAt(source, `scope without name`))
+		return
+	case m.scopes[pfs.Name] != nil:
+		pp.errs = append(pp.errs, errAt(source, fmt.Sprintf(
+			"duplicate scope %s", pfs.Name)))
+		return
+	}
+
+	sm := m.newScope(pfs.Name)
+	for _, agent := range pfs.Agents {
+		if err := m.addAgent(agent, pfs.Name); err != nil {
+			pp.errs = append(pp.errs, errAt(source, fmt.Sprintf(
+				"scope %s: %s", pfs.Name, err.Error())))
+		}
+	}
+	pp.parseDefault(sm, pfs.Default, fmt.Sprintf("%s: scope %s: default", source, pfs.Name))
+	pp.parseNetworks(sm, pfs.Name, pfs.Networks, base)
+	pp.parseInterfaces(sm, pfs.Name, pfs.Interfaces, base)
+	if pfs.Import != `` {
+		pp.importLegacy(sm, pfs.Name, pfs.Import)
+	}
+}
+
+// jsonError adds the position of a JSON decoding error within data to
+// err
+func jsonError(fname string, data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return errAt(fname, err.Error())
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := bytes.Count(data[:offset], []byte{'\n'}) + 1
+	return errAt(fmt.Sprintf("%s:%d", fname, line), err.Error())
+}
+
+// entry converts the file representation into a policyEntry validated
+// against classes, without parsing the prefix
+func (pfe *policyFileEntry) entry(source string, classes map[string]*policyClass) (*policyEntry, error) {
+	e := &policyEntry{
+		Class:    pfe.Class,
+		Labels:   pfe.Labels,
+		Priority: pfe.Priority,
+		Source:   source,
+	}
+	if len(pfe.Actions) > 0 {
+		var err error
+		if e.Actions, err = parseActions(pfe.Actions); err != nil {
+			return nil, errAt(source, err.Error())
+		}
+	}
+	return e, e.validate(classes)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,255 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles writes files, by relative path, into a temporary
+// directory that is removed at the end of the test and returns the
+// directory
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `privprod`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for fname, data := range files {
+		fname = filepath.Join(dir, fname)
+		if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPolicyFileErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, policy, err string
+	}{
+		{`syntax`, "{\n\"networks\": [\n{\"prefix\": }]}", `policy.json:3: invalid character`},
+		{`type`, `{"networks": [], "registry": "no"}`, `cannot unmarshal string`},
+		{`unknown field`, `{"networks": [], "import_dir": "x"}`, `unknown field "import_dir"`},
+		{`unknown entry field`,
+			"{\"networks\": [\n{\"prefix\": \"10.0.0.0/8\", \"class\": \"partner\", \"label\": \"x\"}]}",
+			`policy.json:2: json: unknown field "label"`},
+		{`missing class`, `{"networks": [{"prefix": "10.0.0.0/8"}]}`, `no class configured`},
+		{`unknown class`, `{"networks": [{"prefix": "10.0.0.0/8", "class": "lab"}]}`, `unknown class lab`},
+		{`unknown action`,
+			`{"networks": [{"prefix": "10.0.0.0/8", "class": "partner", "actions": ["drop"]}]}`,
+			`unknown action: drop`},
+		{`empty actions`,
+			`{"classes": [{"name": "lab", "prefix": "0100:f000", "actions": []}], "networks": []}`,
+			`class lab: no actions configured`},
+		{`discard combined`,
+			`{"networks": [{"prefix": "10.0.0.0/8", "class": "partner", "actions": ["discard", "encrypt"]}]}`,
+			`action discard can not be combined`},
+		{`pass combined`,
+			`{"networks": [{"prefix": "10.0.0.0/8", "class": "partner", "actions": ["pass", "ioc"]}]}`,
+			`action pass can not be combined`},
+		{`pseudonymize without prefix`,
+			`{"networks": [{"prefix": "10.0.0.0/8", "class": "discard", "actions": ["pseudonymize"]}]}`,
+			`class discard does not support pseudonymization`},
+		{`special-purpose ioc`,
+			`{"networks": [{"prefix": "10.0.0.0/8", "class": "special-purpose", "actions": ["ioc"]}]}`,
+			`class special-purpose does not support action ioc`},
+		{`invalid prefix`, `{"networks": [{"prefix": "10.0.0.0/33", "class": "partner"}]}`, `invalid CIDR address`},
+		{`default prefix`,
+			`{"default": {"prefix": "0.0.0.0/0", "class": "partner"}, "networks": []}`,
+			`default: prefix not allowed`},
+		{`unknown class action`,
+			`{"classes": [{"name": "lab", "prefix": "0100:f000", "actions": ["drop"]}], "networks": []}`,
+			`class lab: unknown action: drop`},
+		{`unknown mode`,
+			`{"classes": [{"name": "partner", "mode": "random"}], "networks": []}`,
+			`class partner: unknown mode random`},
+		{`invalid pseudonym prefix`,
+			`{"classes": [{"name": "partner", "prefix": "0100:e000:1"}], "networks": []}`,
+			`invalid prefix 0100:e000:1`},
+		{`duplicate class`,
+			"{\"classes\": [\n{\"name\": \"partner\"},\n{\"name\": \"partner\"}], \"networks\": []}",
+			`policy.json:3: duplicate class partner, first defined at`},
+		{`class without name`, `{"classes": [{"prefix": "0100:f000"}], "networks": []}`, `class without name`},
+		{`duplicate scope`,
+			`{"networks": [], "scopes": [{"name": "a", "agents": ["192.0.2.1"], "networks": []},
+			{"name": "a", "agents": ["192.0.2.2"], "networks": []}]}`,
+			`duplicate scope a`},
+		{`invalid agent`,
+			`{"networks": [], "scopes": [{"name": "a", "agents": ["exporter"], "networks": []}]}`,
+			`scope a: invalid agent address: exporter`},
+		{`missing import`, `{"import": "missing", "networks": []}`, `no such file or directory`},
+	} {
+		dir := writeTestFiles(t, map[string]string{`policy.json`: c.policy})
+		_, _, _, errs := parsePolicyFile(filepath.Join(dir, `policy.json`))
+		if len(errs) == 0 {
+			t.Errorf("%s: policy accepted", c.name)
+			continue
+		}
+		if !strings.Contains(errs[0].Error(), c.err) {
+			t.Errorf("%s: error %q, want %q", c.name, errs[0], c.err)
+		}
+	}
+}
+
+func TestPolicyFileErrorsCollected(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{"networks": [
+		{"prefix": "10.0.0.0/8", "class": "lab"},
+		{"prefix": "10.1.0.0/16", "class": "partner"},
+		{"prefix": "10.2.0.0/16", "class": "partner", "actions": ["drop"]}
+	]}`})
+	m, _, _, errs := parsePolicyFile(filepath.Join(dir, `policy.json`))
+	if len(errs) != 2 {
+		t.Fatalf("%d errors, want 2: %v", len(errs), errs)
+	}
+	// valid entries are parsed despite the errors of others
+	if e := m.lookup(net.ParseIP(`10.1.2.3`)); e.Class != classPartner {
+		t.Errorf("valid entry not parsed, classified as %s", e.Class)
+	}
+	if _, _, err := loadPolicyFile(filepath.Join(dir, `policy.json`)); err == nil {
+		t.Errorf("loadPolicyFile accepted an invalid policy")
+	}
+}
+
+func TestPolicyPrecedence(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`policy.json`: `{
+		  "import": "networks",
+		  "default": {"class": "partner"},
+		  "networks": [
+		    {"prefix": "10.0.0.0/8", "class": "infrastructure", "priority": 10},
+		    {"prefix": "10.1.0.0/16", "class": "employee-private"},
+		    {"prefix": "10.2.0.0/16", "class": "employee-private", "priority": 10},
+		    {"prefix": "10.2.3.0/24", "class": "employee-public", "priority": 10},
+		    {"prefix": "192.0.2.0/24", "class": "employee-public", "labels": ["first"]},
+		    {"prefix": "192.0.2.0/24", "class": "employee-private", "labels": ["second"]},
+		    {"prefix": "198.51.100.0/24", "class": "customer"},
+		    {"prefix": "203.0.113.0/24", "class": "partner", "priority": -1}
+		  ],
+		  "scopes": [
+		    {"name": "site-b", "agents": ["192.0.2.10"], "networks": [
+		      {"prefix": "198.51.100.0/24", "class": "employee-public"},
+		      {"prefix": "203.0.113.0/24", "class": "employee-private", "priority": -2}
+		    ]}
+		  ]
+		}`,
+		`networks/company-public.txt`:   ``,
+		`networks/discard.txt`:          ``,
+		`networks/employee-private.txt`: ``,
+		`networks/employee-public.txt`:  ``,
+		`networks/reserved.txt`:         "198.51.100.0/24\n172.16.0.0/12\n",
+	})
+	m, _, err := loadPolicyFile(filepath.Join(dir, `policy.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		agent, ip, class, label string
+	}{
+		// priority before prefix length
+		{``, `10.1.2.3`, classInfrastructure, ``},
+		// prefix length on equal priority
+		{``, `10.2.3.4`, classEmployeePub, ``},
+		{``, `10.2.4.1`, classEmployeePriv, ``},
+		// definition order on equal priority and prefix
+		{``, `192.0.2.1`, classEmployeePub, `first`},
+		// policy file entries are defined before imported entries
+		{``, `198.51.100.1`, classCustomer, ``},
+		{``, `172.16.1.1`, classInfrastructure, ``},
+		// scope before global on equal priority and prefix
+		{`192.0.2.10`, `198.51.100.1`, classEmployeePub, ``},
+		// but priority before scope
+		{`192.0.2.10`, `203.0.113.1`, classPartner, ``},
+		// the default entry if nothing matches
+		{``, `8.8.8.8`, classPartner, ``},
+		{`192.0.2.10`, `8.8.8.8`, classPartner, ``},
+	} {
+		e := m.forAgent(c.agent).lookup(net.ParseIP(c.ip))
+		if e.Class != c.class {
+			t.Errorf("%s via %q: classified as %s by %s, want %s",
+				c.ip, c.agent, e.Class, e.Source, c.class)
+		}
+		if c.label != `` && (len(e.Labels) != 1 || e.Labels[0] != c.label) {
+			t.Errorf("%s: labels %v, want %s", c.ip, e.Labels, c.label)
+		}
+	}
+}
+
+func TestPrecedesTieBreakers(t *testing.T) {
+	entry := func(cidr string, priority int, scope string, order int) *policyEntry {
+		return &policyEntry{Network: mustCIDR(cidr), Priority: priority, Scope: scope, order: order}
+	}
+	for _, c := range []struct {
+		name string
+		e, o *policyEntry
+	}{
+		{`priority`, entry(`10.0.0.0/8`, 1, ``, 1), entry(`10.1.0.0/16`, 0, `a`, 0)},
+		{`prefix length`, entry(`10.1.0.0/16`, 0, ``, 1), entry(`10.0.0.0/8`, 0, `a`, 0)},
+		{`scope`, entry(`10.0.0.0/8`, 0, `a`, 1), entry(`10.0.0.0/8`, 0, ``, 0)},
+		{`order`, entry(`10.0.0.0/8`, 0, ``, 0), entry(`10.0.0.0/8`, 0, ``, 1)},
+		{`scoped order`, entry(`10.0.0.0/8`, 0, `a`, 0), entry(`10.0.0.0/8`, 0, `a`, 1)},
+	} {
+		if !c.e.precedes(c.o) {
+			t.Errorf("%s: entry does not take precedence", c.name)
+		}
+		if c.o.precedes(c.e) {
+			t.Errorf("%s: precedence is not antisymmetric", c.name)
+		}
+	}
+}
+
+func TestRegistryPrecedence(t *testing.T) {
+	x := &policyEntry{Network: mustCIDR(`10.0.0.0/8`), Class: classPartner}
+	y := &policyEntry{Network: mustCIDR(`10.1.2.0/24`), Class: classInfrastructure, Priority: -1}
+	r := &policyEntry{Network: mustCIDR(`10.1.0.0/16`), Class: classSpecialPurpose, builtin: true}
+
+	// x precedes y by priority, the registry replaces x by its longer
+	// prefix, and y would precede the registry by its longer prefix.
+	// The result must not depend on the order of the entries.
+	for _, order := range [][]*policyEntry{
+		{x, y, r}, {x, r, y}, {y, x, r}, {y, r, x}, {r, x, y}, {r, y, x},
+	} {
+		m := newNetworkMap()
+		for _, e := range order {
+			en := *e
+			m.add(&en)
+		}
+		for ip, class := range map[string]string{
+			`10.1.2.3`: classSpecialPurpose,
+			`10.1.3.1`: classSpecialPurpose,
+			`10.2.0.1`: classPartner,
+		} {
+			if e := m.lookup(net.ParseIP(ip)); e.Class != class {
+				t.Errorf("%s: classified as %s with entries in order %s %s %s, want %s", ip, e.Class,
+					order[0].Network, order[1].Network, order[2].Network, class)
+			}
+		}
+	}
+
+	// a higher priority or the same prefix keeps precedence
+	for _, e := range []*policyEntry{
+		{Network: mustCIDR(`10.0.0.0/8`), Priority: 1},
+		{Network: mustCIDR(`10.1.0.0/16`), Priority: -1},
+	} {
+		if e.yields(r) {
+			t.Errorf("%s of priority %d yields to the registry", e.Network, e.Priority)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -12,15 +12,12 @@ package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
 import (
 	"bytes"
 	"crypto"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"hash"
 	"log"
 	"net"
 	"os"
@@ -28,13 +25,10 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/aead/ecdh"
 	"github.com/mjolnir42/erebos"
 	"github.com/mjolnir42/privprod/internal/flowdata"
 	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/poly1305"
 )
 
 type Protector struct {
@@ -48,8 +42,18 @@ type Protector struct {
 	topicIOC     string
 	topicSKey    string
 	topicENC     string
+	topicLinkage string
+	topicIndex   string
+	topicAGG     string
+	topicRisk    string
 	sessionKeyID string
 	sessionKey   []byte
+	recordAEAD   cipher.AEAD
+	unlockKeys   []crypto.PublicKey
+	// index is the unpublished reverse index of the records, which is
+	// published every indexInterval
+	index         *recordIndex
+	indexInterval time.Duration
 }
 
 func (p *Protector) Start() {
@@ -76,6 +80,22 @@ func (p *Protector) Start() {
 	logrus.Infof("Privacy: configured kafka topic for session key export: %s\n", p.topicSKey)
 	p.topicENC = os.Getenv(`KAFKA_PRODUCER_TOPIC_ENCRYPTED`)
 	logrus.Infof("Privacy: configured kafka topic for encrypted data: %s\n", p.topicENC)
+	p.topicLinkage = os.Getenv(`KAFKA_PRODUCER_TOPIC_LINKAGE`)
+	logrus.Infof("Privacy: configured kafka topic for linkage maps: %s\n", p.topicLinkage)
+	p.topicAGG = os.Getenv(`KAFKA_PRODUCER_TOPIC_AGGREGATE`)
+	logrus.Infof("Privacy: configured kafka topic for aggregate statistics: %s\n", p.topicAGG)
+	p.topicRisk = os.Getenv(`KAFKA_PRODUCER_TOPIC_RISK`)
+	logrus.Infof("Privacy: configured kafka topic for the risk report: %s\n", p.topicRisk)
+	p.topicIndex = os.Getenv(`KAFKA_PRODUCER_TOPIC_INDEX`)
+	logrus.Infof("Privacy: configured kafka topic for the record index: %s\n", p.topicIndex)
+	if p.topicIndex != `` {
+		p.index = newRecordIndex()
+		d, err := indexInterval()
+		if p.assert(err) {
+			return
+		}
+		p.indexInterval = d
+	}
 
 	config := sarama.NewConfig()
 	config.Net.KeepAlive = 3 * time.Second
@@ -130,92 +150,38 @@ func (p *Protector) Start() {
 }
 
 func (p *Protector) InitCrypto() {
-	var err error
-	var unlockPKOneIn, unlockPKTwoIn string
-	var unlockPKOne, unlockPKTwo crypto.PublicKey
-	key := flowdata.Key{}
-
 	// fetch public keys to lock session key persistance with
-	unlockPKOneIn = os.Getenv(`UNLOCK_PUBLICKEY_ONE`)
-	unlockPKOne, err = decodePKString(unlockPKOneIn)
-	if p.assert(err) {
-		return
-	}
-
-	unlockPKTwoIn = os.Getenv(`UNLOCK_PUBLICKEY_TWO`)
-	unlockPKTwo, err = decodePKString(unlockPKTwoIn)
-	if p.assert(err) {
-		return
-	}
-
-	// generate common portion of the salt
-	key.Salt = make([]byte, saltLenBytes)
-	_, err = rand.Read(key.Salt)
-	if p.assert(err) {
-		return
+	for _, env := range []string{`UNLOCK_PUBLICKEY_ONE`, `UNLOCK_PUBLICKEY_TWO`} {
+		pk, err := decodePKString(os.Getenv(env))
+		if p.assert(err) {
+			return
+		}
+		p.unlockKeys = append(p.unlockKeys, pk)
 	}
 
 	// generate symmetric session key
 	// BUG: session key is not rotated every 24h
 	p.sessionKey = make([]byte, keyLenBytes)
-	key.Value = make([]byte, keyLenBytes)
-	_, err = rand.Read(p.sessionKey)
+	_, err := rand.Read(p.sessionKey)
 	if p.assert(err) {
 		return
 	}
-	// copy the plaintext sessionkey into the output buffer, which will
-	// be used in-place for encryption
-	copy(key.Value, p.sessionKey)
-
-	// set SessionKeyID
-	p.sessionKeyID = uuid.NewV4().String()
-	key.ID = p.sessionKeyID
-
-	// generate ephemeral asymmetric key used for publishing the
-	// generated session key
-	var priv crypto.PrivateKey
-	var pub crypto.PublicKey
-	priv, pub, err = ecdh.X25519().GenerateKey(nil)
+	p.recordAEAD, err = recordAEAD(p.sessionKey)
 	if p.assert(err) {
 		return
 	}
-	key.PublicKey = pubKeyBytes(pub)
 
-	// encrypt session key with unlock keys
-	for _, pk := range []crypto.PublicKey{unlockPKOne, unlockPKTwo} {
-		slt, err := genKeyedSalt(pk, key.Salt)
-		if p.assert(err) {
-			return
-		}
-		skey, err := deriveKey(priv, pk, key.Salt)
-		if p.assert(err) {
-			return
-		}
-		// setup AES encryption
-		block, err := aes.NewCipher(skey)
-		if p.assert(err) {
-			return
-		}
-		// XOR session key with generated keystream in OFB mode
-		cipher.NewOFB(
-			block,
-			slt,
-		).XORKeyStream(
-			key.Value,
-			key.Value,
-		)
-	}
-	// unlink private session key
-	priv = nil
+	// set SessionKeyID
+	p.sessionKeyID = uuid.NewV4().String()
 
-	key.Serialize()
-	err = key.CalculateMAC()
+	// encrypt session key with unlock keys
+	key, err := wrapKey(p.unlockKeys, p.sessionKeyID, p.sessionKey)
 	if p.assert(err) {
 		return
 	}
 
 	// publish encrypted version of session key
-	jb, err := json.Marshal(&key)
+	jb, err := json.Marshal(key)
 	if p.assert(err) {
 		return
 	}
@@ -233,11 +199,21 @@ func (p *Protector) run() {
 	successEmpty := false
 	producerClosed := false
 
+	// the record index is published in this interval
+	var indexTick <-chan time.Time
+	if p.index != nil {
+		ticker := time.NewTicker(p.indexInterval)
+		defer ticker.Stop()
+		indexTick = ticker.C
+	}
+
 runloop:
 	for {
 		select {
 		case <-p.Shutdown:
 			goto drainloop
+		case <-indexTick:
+			p.flushIndex()
 		case msg := <-p.producer.Errors():
 			log.Printf("Producer error: %s\n",
 				msg.Err.Error(),
@@ -252,8 +228,6 @@ runloop:
 			p.process(msg)
 		}
 	}
-	p.producer.Close()
-	return
 
 	// drain the input channel
 drainloop:
@@ -264,6 +238,7 @@ drainloop:
 				inputEmpty = true
 
 				if !producerClosed {
+					p.flushIndex()
 					p.producer.Close()
 					producerClosed = true
 				}
@@ -306,6 +281,7 @@ func (p *Protector) process(msg *erebos.Transport) {
 		logrus.Errorln(`privacy.Protector.process: ` + err.Error())
 		return
 	}
+	store := networkMaps()
 
 recordloop:
 	for record := range decoded.Convert() {
@@ -325,60 +301,47 @@ recordloop:
 		src := net.ParseIP(record.SrcAddress).To16()
 		dst := net.ParseIP(record.DstAddress).To16()
 
-		if discard(src) || discard(dst) {
+		networks := store.at(record.StartMilli).forAgent(decoded.AgentID)
+		record.MapVersion = networks.version
+		networks.inventory.enrich(&record)
+		srcPolicy, dstPolicy := networks.lookupFlow(&record, src, dst)
+
+		if srcPolicy.Actions.has(actDiscard) || dstPolicy.Actions.has(actDiscard) {
 			continue recordloop
 		}
-
-		if isPrivate(src) && isEmployeePriv(src) {
-			storeEncrypted = true
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(src))
-			record.SrcAddress = fmtEmployeePriv(hash.Sum(nil))
-		} else if isCompany(src) && isEmployeePub(src) {
-			storeEncrypted = true
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(src))
-			record.SrcAddress = fmtEmployeePub(hash.Sum(nil))
-		} else if isPublic(src) {
-			storeEncrypted = true
-			go func(ioc flowdata.IOC) {
-				p.publishIOC(ioc)
-			}(record.ToIOC(src.String()))
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(src))
-			record.SrcAddress = fmtCustomer(hash.Sum(nil))
+		var key *pseudonymKey
+		if srcPolicy.Actions.has(actPseudonymize) || dstPolicy.Actions.has(actPseudonymize) {
+			k, err := pseudoKeys.at(keyTime(&record))
+			if err != nil {
+				logrus.Errorln(`privacy.Protector.process: ` + err.Error())
+				continue recordloop
+			}
+			key = k
+			record.PseudonymEpoch = key.id
+			if done := linkage.rotate(key); len(done) > 0 {
+				go p.publishLinkage(done)
+			}
+		}
+		aggregates.add(&record, src, srcPolicy)
+		// IOCs carry the exact timestamps, they identify their address
+		// anyway
+		p.reportIOC(&record, src, srcPolicy)
+		p.reportIOC(&record, dst, dstPolicy)
+		// the original values are lost unless the record is stored
+		// encrypted
+		if generalizeUnencrypted || srcPolicy.Actions.has(actEncrypt) || dstPolicy.Actions.has(actEncrypt) {
+			generalizeRecord(&record, srcPolicy.class, dstPolicy.class)
+		}
+		if recordLabels {
+			record.SrcClass, record.SrcLabels = srcPolicy.Class, srcPolicy.Labels
+			record.DstClass, record.DstLabels = dstPolicy.Class, dstPolicy.Labels
 		}
 
-		if isPrivate(dst) && isEmployeePriv(dst) {
-			storeEncrypted = true
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(dst))
-			record.DstAddress = fmtEmployeePriv(hash.Sum(nil))
-		} else if isCompany(dst) && isEmployeePub(dst) {
+		if p.protect(&record.SrcAddress, &record.SrcGranularity, src, srcPolicy, key) {
 			storeEncrypted = true
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(dst))
-			record.DstAddress = fmtEmployeePub(hash.Sum(nil))
-		} else if isPublic(dst) {
+		}
+		if p.protect(&record.DstAddress, &record.DstGranularity, dst, dstPolicy, key) {
 			storeEncrypted = true
-			go func(ioc flowdata.IOC) {
-				p.publishIOC(ioc)
-			}(record.ToIOC(dst.String()))
-
-			hash, _ := blake2b.New256(pseudoKey)
-			hash.Write(dataPad)
-			hash.Write([]byte(dst))
-			record.DstAddress = fmtCustomer(hash.Sum(nil))
 		}
 
 		jbytes, err := json.Marshal(&record)
@@ -386,6 +349,7 @@ recordloop:
 			logrus.Errorln(`privacy.Protector.process/storeData: ` + err.Error())
 			continue recordloop
 		}
+		risk.observe(&record, srcPolicy.Class, dstPolicy.Class, time.Now())
 
 		p.dispatch <- &sarama.ProducerMessage{
 			Topic: p.topic,
@@ -393,9 +357,42 @@ recordloop:
 		}
 
 		if storeEncrypted {
+			p.indexRecord(&record, srcPolicy, dstPolicy)
 			go p.encrypt(original.ExportPlaintext())
 		}
 	}
+
+	if done := aggregates.closed(); len(done) > 0 {
+		p.publishAggregates(done)
+	}
+	if rep := risk.due(time.Now()); rep != nil {
+		p.publishRisk(rep)
+	}
+}
+
+// reportIOC publishes address ip of record as IOC if policy entry e
+// has the ioc action. It must be called before record is generalized.
+func (p *Protector) reportIOC(record *flowdata.Record, ip net.IP, e *policyEntry) {
+	if e.Actions.has(actIOC) {
+		go func(ioc flowdata.IOC) {
+			p.publishIOC(ioc)
+		}(record.ToIOC(ip.String()))
+	}
+}
+
+// protect applies the pseudonymize action of policy entry e to address
+// ip, which is stored in addr, pseudonyms are made with key. The
+// prefix length of a pseudonym is stored in granularity. It returns
+// true if the original record must be stored encrypted.
+func (p *Protector) protect(addr *string, granularity *uint8, ip net.IP, e *policyEntry, key *pseudonymKey) bool {
+	if e.Actions.has(actPseudonymize) {
+		var plen int
+		*addr, plen = pseudonymize(ip, e.class, key)
+		linkage.observe(key, e.class, ip, *addr)
+		*granularity = uint8(plen)
+	}
+	*addr = formatAddress(*addr)
+	return e.Actions.has(actEncrypt)
 }
 
 func (p *Protector) InputChannel() chan *erebos.Transport {
@@ -422,81 +419,24 @@ func (p *Protector) publishIOC(ioc flowdata.IOC) {
 func (p *Protector) encrypt(input flowdata.Plaintext) {
 	// binary encoding of received input struct
 	var plain bytes.Buffer
-	var raw, padded, jb []byte
-	var block cipher.Block
-	var err error
-	var b2 hash.Hash
-
 	encoder := gob.NewEncoder(&plain)
-	err = encoder.Encode(input)
+	err := encoder.Encode(input)
 	if p.assert(err) {
 		return
 	}
-	raw = plain.Bytes()
 
 	// setup encrypted struct
 	ctxt := flowdata.EncryptedRecord{}
 	ctxt.RecordID = input.RecordID
 	ctxt.SessionKeyID = p.sessionKeyID
 
-	// generate salt
-	ctxt.RawSalt = make([]byte, saltLenBytes)
-	_, err = rand.Read(ctxt.RawSalt)
-	if p.assert(err) {
-		return
-	}
-	ctxt.Salt = base64.StdEncoding.EncodeToString(ctxt.RawSalt)
-
-	// setup encryption cipher
-	block, err = aes.NewCipher(p.sessionKey)
-	if p.assert(err) {
-		return
-	}
-	mode := cipher.NewCBCEncrypter(block, ctxt.RawSalt)
-
-	// pkcs7 padding the blocksize
-	padded, err = pad(raw, mode.BlockSize())
-	if p.assert(err) {
-		return
-	}
-
-	//
-	ctxt.RawValue = make([]byte, len(padded), len(padded))
-	mode.CryptBlocks(ctxt.RawValue, padded)
-	ctxt.Value = base64.StdEncoding.EncodeToString(ctxt.RawValue)
-
-	// calculate Poly1305 signature
-	b2, err = blake2b.New256(nil)
+	err = sealRecord(p.recordAEAD, plain.Bytes(), &ctxt)
 	if p.assert(err) {
 		return
 	}
-	// calculate hash of the ciphertext for use as authentication key
-	b2.Write([]byte(ctxt.Value))
-	var polyKey [32]byte
-	var polyMAC [16]byte
-	copy(polyKey[:], b2.Sum(nil))
-
-	// calculate MAC over the output encoded fields instead of the raw
-	// []byte fields, so that receiver verification can work directly on
-	// received data
-	poly1305.Sum(
-		&polyMAC, // output buffer
-		bytes.Join(
-			[][]byte{
-				[]byte(ctxt.RecordID),
-				[]byte(ctxt.SessionKeyID),
-				[]byte(ctxt.Salt),
-				[]byte(ctxt.Value),
-			},
-			nil, // separator
-		),
-		&polyKey, // authentication key
-	)
-	ctxt.RawSignature = polyMAC[:]
-	ctxt.Signature = base64.StdEncoding.EncodeToString(ctxt.RawSignature)
 
 	// publish encrypted record
-	jb, err = json.Marshal(&ctxt)
+	jb, err := json.Marshal(&ctxt)
 	if p.assert(err) {
 		logrus.Errorln(`privacy.Protector.process/encrypt: ` + err.Error())
 		return
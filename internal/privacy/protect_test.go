@@ -0,0 +1,230 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/erebos"
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+// testProtector returns a Protector that publishes to the returned
+// channel
+func testProtector(t *testing.T) (*Protector, chan *sarama.ProducerMessage) {
+	t.Helper()
+	aead, err := recordAEAD(make([]byte, keyLenBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan *sarama.ProducerMessage, 64)
+	return &Protector{
+		dispatch:   out,
+		topic:      `data`,
+		topicIOC:   `ioc`,
+		topicENC:   `encrypted`,
+		recordAEAD: aead,
+	}, out
+}
+
+// testFlow returns a flowdata message with one IPv4 record per pair of
+// source and destination addresses, starting at start
+func testFlow(agentID string, start time.Time, addrs ...[2]string) *erebos.Transport {
+	msg := fmt.Sprintf(`{"AgentID": %q, "DataSets": [`, agentID)
+	for i, a := range addrs {
+		if i > 0 {
+			msg += `,`
+		}
+		msg += fmt.Sprintf(`[{"I": 8, "V": %q}, {"I": 12, "V": %q}, {"I": 4, "V": 6},
+			{"I": 7, "V": 50000}, {"I": 11, "V": 443}, {"I": 60, "V": 4},
+			{"I": 152, "V": %d}, {"I": 153, "V": %d}]`,
+			a[0], a[1], start.UnixNano()/1e6, start.UnixNano()/1e6+1500)
+	}
+	return &erebos.Transport{Value: []byte(msg + `]}`)}
+}
+
+// published returns the messages published to topic so far
+func published(out chan *sarama.ProducerMessage, topic string) [][]byte {
+	res := [][]byte{}
+	for {
+		select {
+		case msg := <-out:
+			if msg.Topic == topic {
+				b, _ := msg.Value.Encode()
+				res = append(res, b)
+			}
+		default:
+			return res
+		}
+	}
+}
+
+func TestRecordLabels(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{"networks": [
+	  {"prefix": "10.1.0.0/16", "class": "employee-private", "labels": ["office", "vpn"]},
+	  {"prefix": "172.16.0.0/12", "class": "infrastructure"}
+	]}`})
+	if prev := activeNetworks.Load(); prev != nil {
+		defer activeNetworks.Store(prev)
+	}
+	if err := LoadNetworkMaps(NetworkConfig{PolicyFile: filepath.Join(dir, `policy.json`)}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *keySchedule) { pseudoKeys = s }(pseudoKeys)
+	pseudoKeys = &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	defer func(b bool) { recordLabels = b }(recordLabels)
+	start := time.Date(2021, 7, 14, 10, 30, 0, 0, time.UTC)
+
+	p, out := testProtector(t)
+	originals := []string{`10.1.2.3`, `172.16.0.9`, `8.8.8.8`}
+	for _, original := range originals {
+		// the expanded form of published addresses
+		originals = append(originals, flowdata.FormatIP(original))
+	}
+
+	recordLabels = true
+	p.process(testFlow(`192.0.2.20`, start,
+		[2]string{`10.1.2.3`, `8.8.8.8`}, [2]string{`172.16.0.9`, `10.1.2.3`}))
+	records := published(out, `data`)
+	if len(records) != 2 {
+		t.Fatalf("%d records published, want 2", len(records))
+	}
+	for i, want := range []struct {
+		srcClass, srcLabels, dstClass, dstLabels string
+	}{
+		{classEmployeePriv, `office,vpn`, classCustomer, ``},
+		{classInfrastructure, ``, classEmployeePriv, `office,vpn`},
+	} {
+		r := flowdata.Record{}
+		if err := json.Unmarshal(records[i], &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.SrcClass != want.srcClass || strings.Join(r.SrcLabels, `,`) != want.srcLabels ||
+			r.DstClass != want.dstClass || strings.Join(r.DstLabels, `,`) != want.dstLabels {
+			t.Errorf("record %d: labeled %s %v, %s %v", i, r.SrcClass, r.SrcLabels, r.DstClass, r.DstLabels)
+		}
+		for _, original := range originals {
+			if strings.Contains(string(records[i]), original) {
+				t.Errorf("record %d: original address %s published: %s", i, original, records[i])
+			}
+		}
+	}
+
+	recordLabels = false
+	p.process(testFlow(`192.0.2.20`, start, [2]string{`10.1.2.3`, `8.8.8.8`}))
+	records = published(out, `data`)
+	if len(records) != 1 {
+		t.Fatalf("%d records published, want 1", len(records))
+	}
+	for _, field := range []string{`SrcClass`, `SrcLabels`, `DstClass`, `DstLabels`} {
+		if strings.Contains(string(records[0]), field) {
+			t.Errorf("%s published with disabled labels", field)
+		}
+	}
+}
+
+func TestIOCNotGeneralized(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{
+	  "classes": [{"name": "customer", "generalize": {"time": "1h"}}],
+	  "networks": []
+	}`})
+	if prev := activeNetworks.Load(); prev != nil {
+		defer activeNetworks.Store(prev)
+	}
+	if err := LoadNetworkMaps(NetworkConfig{PolicyFile: filepath.Join(dir, `policy.json`)}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *keySchedule) { pseudoKeys = s }(pseudoKeys)
+	pseudoKeys = &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	start := time.Date(2021, 7, 14, 10, 30, 12, 345e6, time.UTC)
+
+	p, out := testProtector(t)
+	p.process(testFlow(`192.0.2.20`, start, [2]string{`8.8.8.8`, `8.8.4.4`}))
+
+	r := flowdata.Record{}
+	iocs := []flowdata.IOC{}
+	timeout := time.After(5 * time.Second)
+	for len(iocs) < 2 || r.RecordID == `` {
+		select {
+		case msg := <-out:
+			b, _ := msg.Value.Encode()
+			switch msg.Topic {
+			case `data`:
+				if err := json.Unmarshal(b, &r); err != nil {
+					t.Fatal(err)
+				}
+			case `ioc`:
+				ioc := flowdata.IOC{}
+				if err := json.Unmarshal(b, &ioc); err != nil {
+					t.Fatal(err)
+				}
+				iocs = append(iocs, ioc)
+			}
+		case <-timeout:
+			t.Fatalf("%d IOCs published, want 2", len(iocs))
+		}
+	}
+
+	if !r.StartMilli.Equal(start.Truncate(time.Hour)) || r.TimeBucket != 3600000 {
+		t.Errorf("record not generalized, starts at %s", r.StartMilli)
+	}
+	for _, ioc := range iocs {
+		if !ioc.Start.Equal(start) || !ioc.End.Equal(start.Add(1500*time.Millisecond)) {
+			t.Errorf("IOC %s with generalized times %s to %s", ioc.Address, ioc.Start, ioc.End)
+		}
+	}
+}
+
+func TestGeneralizeUnencrypted(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{`policy.json`: `{
+	  "classes": [{"name": "lab", "prefix": "0100:f000", "actions": ["pseudonymize"], "generalize": {"time": "1h"}}],
+	  "networks": [{"prefix": "10.9.0.0/16", "class": "lab"}]
+	}`})
+	if prev := activeNetworks.Load(); prev != nil {
+		defer activeNetworks.Store(prev)
+	}
+	if err := LoadNetworkMaps(NetworkConfig{PolicyFile: filepath.Join(dir, `policy.json`)}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *keySchedule) { pseudoKeys = s }(pseudoKeys)
+	pseudoKeys = &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	defer func(b bool) { generalizeUnencrypted = b }(generalizeUnencrypted)
+	start := time.Date(2021, 7, 14, 10, 30, 12, 345e6, time.UTC)
+
+	p, out := testProtector(t)
+	for _, want := range []struct {
+		enabled bool
+		start   time.Time
+	}{
+		{false, start},
+		{true, start.Truncate(time.Hour)},
+	} {
+		generalizeUnencrypted = want.enabled
+		p.process(testFlow(`192.0.2.20`, start, [2]string{`10.9.0.1`, `10.9.0.2`}))
+		records := published(out, `data`)
+		if len(records) != 1 {
+			t.Fatalf("%d records published, want 1", len(records))
+		}
+		r := flowdata.Record{}
+		if err := json.Unmarshal(records[0], &r); err != nil {
+			t.Fatal(err)
+		}
+		if !r.StartMilli.Equal(want.start) {
+			t.Errorf("generalize unencrypted %t: record starts at %s, want %s",
+				want.enabled, r.StartMilli, want.start)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
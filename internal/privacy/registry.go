@@ -0,0 +1,83 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+// specialPurpose is the builtin registry of special-purpose address
+// blocks, following RFC 6890 and the IANA special-purpose address
+// registries, plus the multicast ranges. Private-use, shared and
+// unique local address space is left out, since the operator assigns
+// it to employees and customers who must be protected. The transition
+// prefixes 64:ff9b::/96, 64:ff9b:1::/48, 2002::/16 and 2001::/32
+// (Teredo) are left out as well, their addresses are classified by the
+// embedded IPv4 address. IPv4-mapped addresses are classified as IPv4
+// addresses.
+var specialPurpose = []struct {
+	prefix, label string
+}{
+	{`0.0.0.0/8`, `this-network`},
+	{`127.0.0.0/8`, `loopback`},
+	{`169.254.0.0/16`, `link-local`},
+	{`192.0.0.0/24`, `ietf-protocol-assignments`},
+	{`192.0.2.0/24`, `documentation`},
+	{`192.31.196.0/24`, `as112`},
+	{`192.52.193.0/24`, `amt`},
+	{`192.88.99.0/24`, `6to4-relay-anycast`},
+	{`192.175.48.0/24`, `as112`},
+	{`198.18.0.0/15`, `benchmarking`},
+	{`198.51.100.0/24`, `documentation`},
+	{`203.0.113.0/24`, `documentation`},
+	{`224.0.0.0/4`, `multicast`},
+	{`240.0.0.0/4`, `reserved`},
+	{`255.255.255.255/32`, `limited-broadcast`},
+	{`::/128`, `unspecified`},
+	{`::1/128`, `loopback`},
+	{`100::/64`, `discard-only`},
+	{`2001:1::1/128`, `port-control-protocol-anycast`},
+	{`2001:1::2/128`, `turn-anycast`},
+	{`2001:2::/48`, `benchmarking`},
+	{`2001:3::/32`, `amt`},
+	{`2001:4:112::/48`, `as112`},
+	{`2001:10::/28`, `orchid`},
+	{`2001:20::/28`, `orchid`},
+	{`2001:db8::/32`, `documentation`},
+	{`2620:4f:8000::/48`, `as112`},
+	{`3fff::/20`, `documentation`},
+	{`5f00::/16`, `srv6-sid`},
+	{`fe80::/10`, `link-local`},
+	{`ff00::/8`, `multicast`},
+}
+
+// addRegistry adds the special-purpose registry to m. Its entries are
+// defined after all other entries of m, so that entries of the same
+// prefix take precedence.
+func (m *networkMap) addRegistry() {
+	c := m.classes[classSpecialPurpose]
+	for _, sp := range specialPurpose {
+		m.add(&policyEntry{
+			Network:  mustCIDR(sp.prefix),
+			Class:    classSpecialPurpose,
+			Labels:   []string{sp.label},
+			Actions:  c.Actions,
+			Priority: legacyPriorityDefault,
+			class:    c,
+			Source:   `special-purpose registry`,
+			builtin:  true,
+		})
+	}
+}
+
+// legacyRegistry reports if the special-purpose registry applies to
+// the legacy network files, unless PRIVACY_SPECIAL_PURPOSE_REGISTRY is
+// set to false. Policy files configure it with their registry setting.
+func legacyRegistry() (bool, error) {
+	enabled := true
+	err := loadEnv(envSetting{`PRIVACY_SPECIAL_PURPOSE_REGISTRY`, envBool(&enabled)})
+	return enabled, err
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
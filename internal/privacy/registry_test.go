@@ -0,0 +1,156 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpecialPurposeRegistry(t *testing.T) {
+	m := newNetworkMap()
+	for _, cidr := range []string{`10.0.0.0/8`, `fd00:1::/32`, `127.1.0.0/16`} {
+		m.add(&policyEntry{
+			Network: mustCIDR(cidr),
+			Class:   classInfrastructure,
+			Actions: actPseudonymize | actEncrypt,
+			class:   m.classes[classInfrastructure],
+		})
+	}
+	// a configured entry of a longer prefix wins despite its priority
+	m.add(&policyEntry{
+		Network:  mustCIDR(`169.254.1.0/24`),
+		Class:    classEmployeePriv,
+		Actions:  actPseudonymize | actEncrypt,
+		Priority: -10,
+		class:    m.classes[classEmployeePriv],
+	})
+	m.addRegistry()
+
+	for _, c := range []struct {
+		ip, class string
+	}{
+		{`127.0.0.1`, classSpecialPurpose},
+		{`169.254.2.1`, classSpecialPurpose},
+		{`255.255.255.255`, classSpecialPurpose},
+		{`239.255.255.250`, classSpecialPurpose},
+		{`ff02::1`, classSpecialPurpose},
+		{`fe80::1`, classSpecialPurpose},
+		{`::`, classSpecialPurpose},
+		// private-use, shared and unique local addresses are not
+		// special-purpose
+		{`192.168.1.5`, classCustomer},
+		{`100.64.1.1`, classCustomer},
+		{`fd00:2::1`, classCustomer},
+		// entries of the same or a longer prefix take precedence
+		{`10.1.2.3`, classInfrastructure},
+		{`fd00:1::1`, classInfrastructure},
+		{`127.1.0.1`, classInfrastructure},
+		{`169.254.1.1`, classEmployeePriv},
+		{`8.8.8.8`, classCustomer},
+		// transition prefixes are classified by the embedded address
+		{`64:ff9b::808:808`, classCustomer},
+		{`2001:0:4136:e378:8000:63bf:f7f7:f7f7`, classCustomer},
+	} {
+		e := m.lookup(net.ParseIP(c.ip))
+		if e.Class != c.class {
+			t.Errorf("%s: classified as %s, want %s", c.ip, e.Class, c.class)
+		}
+		if e.Class == classSpecialPurpose && e.Actions.has(actIOC) {
+			t.Errorf("%s: special-purpose address reported as IOC", c.ip)
+		}
+		if e.Class != classSpecialPurpose && !e.Actions.has(actPseudonymize) {
+			t.Errorf("%s: not pseudonymized", c.ip)
+		}
+	}
+
+	pfc := policyFileClass{Name: classSpecialPurpose, Actions: []string{`ioc`}}
+	if err := pfc.define(m.classes, `test`); err == nil {
+		t.Errorf("special-purpose class accepted action ioc")
+	}
+}
+
+func TestSpecialPurposeLegacyPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `privprod`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for fname, data := range map[string]string{
+		`company-public.txt`:   ``,
+		`discard.txt`:          ``,
+		`employee-public.txt`:  ``,
+		`reserved.txt`:         "10.0.0.0/8\n172.16.0.0/12\n",
+		`employee-private.txt`: "10.1.0.0/16\n172.16.5.0/24\n192.168.1.0/24\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fname), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, _, err := loadNetworks(``, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ip, class string
+	}{
+		{`10.1.2.3`, classEmployeePriv},
+		{`172.16.5.1`, classEmployeePriv},
+		{`172.16.6.1`, classInfrastructure},
+		// outside of the reserved networks, as in the legacy files
+		{`192.168.1.5`, classCustomer},
+		{`100.64.0.1`, classCustomer},
+	} {
+		e := m.lookup(net.ParseIP(c.ip))
+		if e.Class != c.class || !e.Actions.has(actPseudonymize|actEncrypt) {
+			t.Errorf("%s: classified as %s [%s], want pseudonymized %s",
+				c.ip, e.Class, e.Actions, c.class)
+		}
+	}
+}
+
+func TestSpecialPurposeLegacySwitch(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		`company-public.txt`:   ``,
+		`discard.txt`:          ``,
+		`employee-private.txt`: ``,
+		`employee-public.txt`:  ``,
+		`reserved.txt`:         ``,
+	})
+	ip := net.ParseIP(`127.0.0.1`)
+	for _, c := range []struct {
+		env, class string
+	}{
+		{``, classSpecialPurpose},
+		{`true`, classSpecialPurpose},
+		{`false`, classCustomer},
+	} {
+		setenv(t, map[string]string{`PRIVACY_SPECIAL_PURPOSE_REGISTRY`: c.env})
+		m, _, _, err := loadNetworks(``, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := m.lookup(ip); e.Class != c.class {
+			t.Errorf("%q: classified as %s, want %s", c.env, e.Class, c.class)
+		}
+	}
+
+	setenv(t, map[string]string{`PRIVACY_SPECIAL_PURPOSE_REGISTRY`: `sometimes`})
+	if _, _, _, err := loadNetworks(``, dir); err == nil {
+		t.Errorf("invalid PRIVACY_SPECIAL_PURPOSE_REGISTRY accepted")
+	}
+	expectFindings(t, CheckNetworks(NetworkConfig{Path: dir}), [][3]string{
+		{``, LevelError, `invalid PRIVACY_SPECIAL_PURPOSE_REGISTRY: sometimes`},
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
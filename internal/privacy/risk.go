@@ -0,0 +1,308 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/privprod/internal/flowdata"
+	"github.com/sirupsen/logrus"
+)
+
+// riskPattern is the source class, destination class and service of a
+// combination of quasi-identifiers
+type riskPattern struct {
+	srcClass string
+	dstClass string
+	protocol uint8
+	port     uint16
+}
+
+// riskCombo counts the records of one combination of quasi-identifiers
+type riskCombo struct {
+	pattern riskPattern
+	count   int64
+}
+
+// riskSlot holds the combinations seen during one interval
+type riskSlot struct {
+	start     time.Time
+	combos    map[uint64]*riskCombo
+	truncated bool
+}
+
+// riskTracker collects the combinations of quasi-identifiers of the
+// published records of all handlers
+type riskTracker struct {
+	window   time.Duration
+	interval time.Duration
+	limit    int
+	patterns int
+
+	lock  sync.Mutex
+	slots []*riskSlot
+	// reported is the start of the interval of the last report
+	reported time.Time
+}
+
+// risk is the tracker of all handlers, nil if the risk report is
+// disabled
+var risk *riskTracker
+
+// LoadRiskReport configures the re-identification risk report from
+// the environment. It must be called before the first Protector is
+// started.
+func LoadRiskReport() error {
+	var err error
+	risk, err = newRiskTracker()
+	if risk != nil {
+		logrus.Infof("Privacy: publishing risk report over %s every %s\n",
+			risk.window, risk.interval)
+	}
+	return err
+}
+
+// newRiskTracker returns the tracker configured by the environment, or
+// nil if no window is configured
+func newRiskTracker() (*riskTracker, error) {
+	if os.Getenv(`PRIVACY_RISK_WINDOW`) == `` {
+		return nil, nil
+	}
+	rt := &riskTracker{
+		interval: 15 * time.Minute,
+		limit:    1000000,
+		patterns: 10,
+	}
+	if err := loadEnv(
+		envSetting{`PRIVACY_RISK_WINDOW`, envDuration(&rt.window)},
+		envSetting{`PRIVACY_RISK_INTERVAL`, envDuration(&rt.interval)},
+		envSetting{`PRIVACY_RISK_LIMIT`, envInt(&rt.limit)},
+		envSetting{`PRIVACY_RISK_PATTERNS`, envInt(&rt.patterns)},
+	); err != nil {
+		return nil, err
+	}
+	switch {
+	case rt.interval < time.Minute || rt.window < rt.interval:
+		return nil, fmt.Errorf("invalid risk window %s with interval %s", rt.window, rt.interval)
+	case rt.limit < 1 || rt.patterns < 0:
+		return nil, fmt.Errorf("invalid risk report limits")
+	}
+	return rt, nil
+}
+
+// observe counts the published record r, whose source and destination
+// have the classes src and dst, at the time now
+func (rt *riskTracker) observe(r *flowdata.Record, src, dst string, now time.Time) {
+	if rt == nil {
+		return
+	}
+	h := fnv.New64a()
+	var b [10]byte
+	binary.BigEndian.PutUint16(b[0:2], r.DstPort)
+	binary.BigEndian.PutUint64(b[2:10], uint64(r.StartMilli.UnixNano()))
+	h.Write([]byte(r.SrcAddress))
+	h.Write([]byte{0})
+	h.Write([]byte(r.DstAddress))
+	h.Write([]byte{0})
+	h.Write(b[:])
+	id := h.Sum64()
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	start := now.Truncate(rt.interval)
+	if rt.reported.IsZero() {
+		rt.reported = start
+	}
+	var s *riskSlot
+	if n := len(rt.slots); n > 0 && rt.slots[n-1].start.Equal(start) {
+		s = rt.slots[n-1]
+	} else {
+		s = &riskSlot{start: start, combos: map[uint64]*riskCombo{}}
+		rt.slots = append(rt.slots, s)
+	}
+	if c, ok := s.combos[id]; ok {
+		c.count++
+		return
+	}
+	if len(s.combos) >= rt.limit {
+		if !s.truncated {
+			logrus.Warnf("Privacy: risk report limit of %d combinations reached\n", rt.limit)
+			s.truncated = true
+		}
+		return
+	}
+	s.combos[id] = &riskCombo{
+		pattern: riskPattern{
+			srcClass: src,
+			dstClass: dst,
+			protocol: r.ProtocolID,
+			port:     r.DstPort,
+		},
+		count: 1,
+	}
+}
+
+// due returns the report of the window ending at the last completed
+// interval, if it was not reported yet, or nil
+func (rt *riskTracker) due(now time.Time) *flowdata.RiskReport {
+	if rt == nil {
+		return nil
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	end := now.Truncate(rt.interval)
+	if rt.reported.IsZero() || !end.After(rt.reported) {
+		return nil
+	}
+	rt.reported = end
+	start := end.Add(-rt.window)
+
+	// drop the slots that left the window, and merge the others
+	slots := []*riskSlot{}
+	combos := map[uint64]*riskCombo{}
+	truncated := false
+	for _, s := range rt.slots {
+		if s.start.Before(start) {
+			continue
+		}
+		slots = append(slots, s)
+		if !s.start.Before(end) {
+			continue
+		}
+		truncated = truncated || s.truncated
+		for id, c := range s.combos {
+			if m, ok := combos[id]; ok {
+				m.count += c.count
+				continue
+			}
+			combos[id] = &riskCombo{pattern: c.pattern, count: c.count}
+		}
+	}
+	rt.slots = slots
+	rep := rt.report(combos)
+	rep.Start, rep.End, rep.Truncated = start.UTC(), end.UTC(), truncated
+	return rep
+}
+
+// report computes the statistics of combos
+func (rt *riskTracker) report(combos map[uint64]*riskCombo) *flowdata.RiskReport {
+	rep := &flowdata.RiskReport{
+		Classes:  []flowdata.RiskClass{},
+		Patterns: []flowdata.RiskPattern{},
+	}
+	classes := map[string]*flowdata.RiskClass{}
+	patterns := map[riskPattern]*flowdata.RiskPattern{}
+	for _, c := range combos {
+		rep.Records += c.count
+		rep.Combinations++
+
+		rc, ok := classes[c.pattern.srcClass]
+		if !ok {
+			rc = &flowdata.RiskClass{Class: c.pattern.srcClass, MinK: c.count}
+			classes[c.pattern.srcClass] = rc
+		}
+		rc.Records += c.count
+		rc.Combinations++
+		if c.count < rc.MinK {
+			rc.MinK = c.count
+		}
+		// the shares are divided by the records below
+		switch {
+		case c.count < 2:
+			rc.Unique++
+			rc.BelowK2 += float64(c.count)
+			fallthrough
+		case c.count < 5:
+			rc.BelowK5 += float64(c.count)
+			fallthrough
+		case c.count < 10:
+			rc.BelowK10 += float64(c.count)
+		}
+
+		rp, ok := patterns[c.pattern]
+		if !ok {
+			rp = &flowdata.RiskPattern{
+				SrcClass:   c.pattern.srcClass,
+				DstClass:   c.pattern.dstClass,
+				ProtocolID: c.pattern.protocol,
+				DstPort:    c.pattern.port,
+			}
+			patterns[c.pattern] = rp
+		}
+		rp.Records += c.count
+		if c.count == 1 {
+			rp.Unique++
+		}
+	}
+
+	for _, rc := range classes {
+		rc.BelowK2 /= float64(rc.Records)
+		rc.BelowK5 /= float64(rc.Records)
+		rc.BelowK10 /= float64(rc.Records)
+		rep.Classes = append(rep.Classes, *rc)
+	}
+	sort.Slice(rep.Classes, func(i, j int) bool {
+		return rep.Classes[i].Class < rep.Classes[j].Class
+	})
+
+	for _, rp := range patterns {
+		if rp.Unique > 0 {
+			rep.Patterns = append(rep.Patterns, *rp)
+		}
+	}
+	sort.Slice(rep.Patterns, func(i, j int) bool {
+		x, y := rep.Patterns[i], rep.Patterns[j]
+		switch {
+		case x.Unique != y.Unique:
+			return x.Unique > y.Unique
+		case x.Records != y.Records:
+			return x.Records < y.Records
+		case x.SrcClass != y.SrcClass:
+			return x.SrcClass < y.SrcClass
+		case x.DstClass != y.DstClass:
+			return x.DstClass < y.DstClass
+		case x.ProtocolID != y.ProtocolID:
+			return x.ProtocolID < y.ProtocolID
+		}
+		return x.DstPort < y.DstPort
+	})
+	if len(rep.Patterns) > rt.patterns {
+		rep.Patterns = rep.Patterns[:rt.patterns]
+	}
+	return rep
+}
+
+// publishRisk publishes the risk report rep
+func (p *Protector) publishRisk(rep *flowdata.RiskReport) {
+	if p.topicRisk == `` {
+		logrus.Warnln(`Privacy: no kafka topic for the risk report configured`)
+		return
+	}
+	jb, err := json.Marshal(rep)
+	if err != nil {
+		logrus.Errorln(`privacy.Protector.publishRisk: ` + err.Error())
+		return
+	}
+	p.dispatch <- &sarama.ProducerMessage{
+		Topic: p.topicRisk,
+		Value: sarama.ByteEncoder(jb),
+	}
+	logrus.Infof("Privacy: published risk report of %d records in %d combinations\n",
+		rep.Records, rep.Combinations)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,66 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/privprod/internal/flowdata"
+)
+
+func TestRiskReport(t *testing.T) {
+	rt := &riskTracker{
+		window:   2 * time.Hour,
+		interval: time.Hour,
+		limit:    100,
+		patterns: 1,
+	}
+	now := time.Date(2021, 7, 14, 10, 30, 0, 0, time.UTC)
+	start := now.Truncate(time.Minute)
+	rec := func(src string, port uint16) *flowdata.Record {
+		return &flowdata.Record{SrcAddress: src, DstAddress: `192.0.2.1`,
+			ProtocolID: 6, DstPort: port, StartMilli: start}
+	}
+
+	// three records share their quasi-identifiers, two are unique
+	for i := 0; i < 3; i++ {
+		rt.observe(rec(`10.0.0.0`, 443), classEmployeePriv, classPartner, now)
+	}
+	rt.observe(rec(`10.0.0.1`, 443), classEmployeePriv, classPartner, now)
+	rt.observe(rec(`10.0.0.2`, 22), classEmployeePriv, classPartner, now)
+
+	if rep := rt.due(now.Add(time.Minute)); rep != nil {
+		t.Fatalf("report of an incomplete interval")
+	}
+	rep := rt.due(now.Add(time.Hour))
+	if rep == nil {
+		t.Fatalf("no report after the interval")
+	}
+	if rep.Records != 5 || rep.Combinations != 3 || len(rep.Classes) != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	c := rep.Classes[0]
+	if c.Unique != 2 || c.MinK != 1 || c.BelowK2 != 0.4 || c.BelowK5 != 1 {
+		t.Errorf("unexpected class statistics: %+v", c)
+	}
+	if len(rep.Patterns) != 1 || rep.Patterns[0].DstPort != 22 {
+		t.Errorf("unexpected patterns: %+v", rep.Patterns)
+	}
+	if rt.due(now.Add(time.Hour)) != nil {
+		t.Errorf("interval reported twice")
+	}
+
+	// the records leave the sliding window
+	rep = rt.due(now.Add(3 * time.Hour))
+	if rep == nil || rep.Records != 0 || len(rt.slots) != 0 {
+		t.Errorf("records outside of the window reported: %+v", rep)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
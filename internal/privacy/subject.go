@@ -0,0 +1,145 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// maxSubjectEpochs limits the date range of a subject lookup
+const maxSubjectEpochs = 3660
+
+// SubjectPseudonym is a pseudonym an address may have been published
+// as
+type SubjectPseudonym struct {
+	Address string
+	Epoch   string
+	// Version is the network map version that assigned Class
+	Version     string
+	Class       string
+	Pseudonym   string
+	Granularity int
+	// Error is set if the key of Epoch is not available
+	Error string
+}
+
+// SubjectLookup returns the pseudonyms of addrs in all epochs between
+// from and to, using the active network maps and the pseudonym keys
+// configured by the environment. Since interface rules and scopes can
+// assign other classes to an address, the pseudonyms of all classes
+// that may apply to an address are returned.
+func SubjectLookup(addrs []string, from, to time.Time) ([]SubjectPseudonym, error) {
+	store := networkMaps()
+	if store == nil {
+		return nil, fmt.Errorf("no network maps loaded")
+	}
+	keys, err := keyScheduleFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", addr)
+		}
+		ips = append(ips, ip.To16())
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("end of date range before its start")
+	}
+
+	res := []SubjectPseudonym{}
+	for t, n := from, 0; !t.After(to); n++ {
+		if n == maxSubjectEpochs {
+			return nil, fmt.Errorf("date range exceeds %d epochs", maxSubjectEpochs)
+		}
+		key, err := keys.at(t)
+		if err != nil {
+			id, _, end := keys.epoch(t)
+			res = append(res, SubjectPseudonym{Epoch: id, Error: err.Error()})
+			t = end
+			continue
+		}
+		for _, ip := range ips {
+			res = append(res, store.subjectPseudonyms(ip, key)...)
+		}
+		if key.id == epochStatic {
+			break
+		}
+		t = key.end
+	}
+	return res, nil
+}
+
+// subjectPseudonyms returns the pseudonyms of ip made with key, for
+// all network map versions effective during its epoch
+func (s *networkStore) subjectPseudonyms(ip net.IP, key *pseudonymKey) []SubjectPseudonym {
+	maps := s.versions
+	if key.id != epochStatic {
+		maps = []*networkMap{s.at(key.start)}
+		for _, m := range s.versions {
+			if m.effective.After(key.start) && m.effective.Before(key.end) {
+				maps = append(maps, m)
+			}
+		}
+	}
+
+	res := []SubjectPseudonym{}
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for _, e := range m.candidates(ip) {
+			if !e.Actions.has(actPseudonymize) {
+				continue
+			}
+			p, plen := pseudonymize(ip, e.class, key)
+			p = formatAddress(p)
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			res = append(res, SubjectPseudonym{
+				Address:     ip.String(),
+				Epoch:       key.id,
+				Version:     m.version,
+				Class:       e.Class,
+				Pseudonym:   p,
+				Granularity: plen,
+			})
+		}
+	}
+	return res
+}
+
+// candidates returns all policy entries that may apply to ip, in the
+// global map and all scopes, including all interface rules
+func (m *networkMap) candidates(ip net.IP) []*policyEntry {
+	maps := []*networkMap{m}
+	names := make([]string, 0, len(m.scopes))
+	for name := range m.scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		maps = append(maps, m.scopes[name])
+	}
+
+	res := []*policyEntry{}
+	for _, sm := range maps {
+		res = append(res, sm.lookup(ip))
+		for _, ir := range sm.rules {
+			res = append(res, ir.entry)
+		}
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,60 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubjectPseudonyms(t *testing.T) {
+	m := newNetworkMap()
+	pfi := policyFileInterface{Address: `src`}
+	pfi.Class = classEmployeePub
+	ir, err := pfi.rule(`test`, m.classes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.rules = append(m.rules, ir)
+	m.add(&policyEntry{
+		Network: mustCIDR(`192.0.2.0/24`),
+		Class:   classDiscard,
+		Actions: actDiscard,
+		class:   m.classes[classDiscard],
+	})
+	s := &networkStore{versions: []*networkMap{m}}
+
+	keys := &keySchedule{length: 24 * time.Hour, master: make([]byte, keyLenBytes)}
+	day, _ := time.Parse(time.RFC3339, `2021-07-14T12:00:00Z`)
+	key, _ := keys.at(day)
+
+	ip := net.ParseIP(`8.8.8.8`).To16()
+	res := s.subjectPseudonyms(ip, key)
+	classes := map[string]string{}
+	for _, sp := range res {
+		classes[sp.Class] = sp.Pseudonym
+	}
+	for _, class := range []string{classCustomer, classEmployeePub} {
+		p, _ := pseudonymize(ip, m.classes[class], key)
+		if classes[class] != formatAddress(p) {
+			t.Errorf("%s: pseudonym %s, want %s", class, classes[class], formatAddress(p))
+		}
+	}
+	if len(res) != 2 {
+		t.Errorf("%d pseudonyms, want 2", len(res))
+	}
+
+	// discarded addresses only have pseudonyms of interface rules
+	res = s.subjectPseudonyms(net.ParseIP(`192.0.2.1`).To16(), key)
+	if len(res) != 1 || res[0].Class != classEmployeePub {
+		t.Errorf("unexpected pseudonyms of a discarded address: %v", res)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
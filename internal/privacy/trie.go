@@ -0,0 +1,237 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"net"
+)
+
+// netTrie is a path compressed binary radix tree over network
+// prefixes. IPv4 and IPv6 networks are kept in separate trees, to
+// match the behaviour of net.IPNet.Contains which never matches an
+// IPv4 address against an IPv6 network.
+type netTrie struct {
+	root4 *trieNode
+	root6 *trieNode
+	size  int
+}
+
+type trieNode struct {
+	key     [net.IPv6len]byte
+	plen    int
+	entries []*policyEntry
+	child   [2]*trieNode
+}
+
+func newNetTrie() *netTrie {
+	return &netTrie{}
+}
+
+// Insert adds policy entry e to the trie, keyed by its network.
+// Multiple entries for the same network are kept in insertion order.
+func (t *netTrie) Insert(e *policyEntry) {
+	key, plen, v4 := trieKey(e.Network)
+	if key == nil {
+		return
+	}
+
+	node := &t.root6
+	if v4 {
+		node = &t.root4
+	}
+
+	leaf := &trieNode{plen: plen, entries: []*policyEntry{e}}
+	copy(leaf.key[:], key)
+
+	for {
+		cur := *node
+		if cur == nil {
+			*node = leaf
+			t.size++
+			return
+		}
+
+		common := commonPrefixLen(cur.key[:], leaf.key[:], minInt(cur.plen, plen))
+		switch {
+		case common == cur.plen && common == plen:
+			// same prefix, possibly a former branch node
+			if len(cur.entries) == 0 {
+				t.size++
+			}
+			cur.entries = append(cur.entries, e)
+			return
+		case common == cur.plen:
+			// cur contains the new network, descend
+			node = &cur.child[bitAt(leaf.key[:], cur.plen)]
+		case common == plen:
+			// the new network contains cur
+			leaf.child[bitAt(cur.key[:], plen)] = cur
+			*node = leaf
+			t.size++
+			return
+		default:
+			// prefixes diverge, add a branch node at the common
+			// prefix length
+			branch := &trieNode{plen: common}
+			copy(branch.key[:], leaf.key[:])
+			maskKey(branch.key[:], common)
+			branch.child[bitAt(leaf.key[:], common)] = leaf
+			branch.child[bitAt(cur.key[:], common)] = cur
+			*node = branch
+			t.size++
+			return
+		}
+	}
+}
+
+// Lookup walks the trie along ip and returns the entry that takes
+// precedence over all other entries whose network contains ip, or nil
+// if there is no such entry. The special-purpose registry is resolved
+// after the configured entries.
+func (t *netTrie) Lookup(ip net.IP) *policyEntry {
+	var winner, registry *policyEntry
+	t.visit(ip, func(e *policyEntry) {
+		switch {
+		case e.builtin:
+			if registry == nil || e.precedes(registry) {
+				registry = e
+			}
+		case winner == nil || e.precedes(winner):
+			winner = e
+		}
+	})
+	if registry != nil && (winner == nil || winner.yields(registry)) {
+		return registry
+	}
+	return winner
+}
+
+// Matches returns all entries whose network contains ip, from the
+// least to the most specific network
+func (t *netTrie) Matches(ip net.IP) []*policyEntry {
+	res := []*policyEntry{}
+	t.visit(ip, func(e *policyEntry) {
+		res = append(res, e)
+	})
+	return res
+}
+
+// visit calls fn for all entries whose network contains ip
+func (t *netTrie) visit(ip net.IP, fn func(*policyEntry)) {
+	var key []byte
+	var node *trieNode
+	if ip4 := ip.To4(); ip4 != nil {
+		key, node = ip4, t.root4
+	} else if len(ip) == net.IPv6len {
+		key, node = ip, t.root6
+	}
+
+	maxLen := len(key) * 8
+	for node != nil {
+		if commonPrefixLen(node.key[:], key, node.plen) != node.plen {
+			return
+		}
+		for _, e := range node.entries {
+			fn(e)
+		}
+		if node.plen == maxLen {
+			return
+		}
+		node = node.child[bitAt(key, node.plen)]
+	}
+}
+
+// Len returns the number of distinct networks in the trie
+func (t *netTrie) Len() int {
+	return t.size
+}
+
+// Walk calls fn for every entry in the trie, IPv4 networks first
+func (t *netTrie) Walk(fn func(*policyEntry)) {
+	walkTrie(t.root4, fn)
+	walkTrie(t.root6, fn)
+}
+
+func walkTrie(node *trieNode, fn func(*policyEntry)) {
+	if node == nil {
+		return
+	}
+	for _, e := range node.entries {
+		fn(e)
+	}
+	walkTrie(node.child[0], fn)
+	walkTrie(node.child[1], fn)
+}
+
+// trieKey returns the masked network address of n, its prefix length
+// and whether n is an IPv4 network
+func trieKey(n *net.IPNet) ([]byte, int, bool) {
+	ones, bits := n.Mask.Size()
+	switch {
+	case bits == 8*net.IPv4len && n.IP.To4() != nil:
+		key := make([]byte, net.IPv4len)
+		copy(key, n.IP.To4())
+		maskKey(key, ones)
+		return key, ones, true
+	case bits == 8*net.IPv6len && len(n.IP) == net.IPv6len:
+		key := make([]byte, net.IPv6len)
+		copy(key, n.IP)
+		maskKey(key, ones)
+		return key, ones, false
+	}
+	return nil, 0, false
+}
+
+// commonPrefixLen returns the number of leading bits a and b have in
+// common, up to max
+func commonPrefixLen(a, b []byte, max int) int {
+	n := 0
+	for i := 0; n < max && i < len(a) && i < len(b); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// bitAt returns bit i of key, counted from the most significant bit
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// maskKey zeroes all bits of key after the first plen bits
+func maskKey(key []byte, plen int) {
+	for i := range key {
+		switch {
+		case plen >= 8*(i+1):
+		case plen <= 8*i:
+			key[i] = 0
+		default:
+			key[i] &= ^byte(0xff >> uint(plen-8*i))
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
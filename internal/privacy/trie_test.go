@@ -0,0 +1,214 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// legacyMaps is the former map based network classification, kept
+// to compare the trie against
+type legacyMaps struct {
+	employeePriv map[string]*net.IPNet
+	employeePub  map[string]*net.IPNet
+	companyPub   map[string]*net.IPNet
+	reservedPriv map[string]*net.IPNet
+	discard      map[string]*net.IPNet
+}
+
+func contains(m map[string]*net.IPNet, ip net.IP) bool {
+	for i := range m {
+		if m[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify mirrors the sequence of checks process performed per
+// address with the map based implementation. It returns the class of
+// the pseudonym, or the action if the address is not pseudonymized.
+// Reserved and company addresses, which passed in cleartext, are
+// pseudonymized as infrastructure.
+func (l *legacyMaps) classify(ip net.IP) string {
+	if contains(l.discard, ip) {
+		return classDiscard
+	}
+	if contains(l.reservedPriv, ip) && contains(l.employeePriv, ip) {
+		return classEmployeePriv
+	}
+	if contains(l.companyPub, ip) && contains(l.employeePub, ip) {
+		return classEmployeePub
+	}
+	if !contains(l.reservedPriv, ip) && !contains(l.companyPub, ip) {
+		return classCustomer
+	}
+	return classInfrastructure
+}
+
+// classify returns the same classification as legacyMaps.classify
+// from the network map
+func (m *networkMap) classify(ip net.IP) string {
+	e := m.lookup(ip)
+	switch {
+	case e.Actions.has(actDiscard):
+		return classDiscard
+	case e.Actions.has(actPass):
+		return `pass`
+	}
+	return e.Class
+}
+
+// testNetworks generates n random networks per legacy network file
+// and returns the imported network map together with the legacy maps
+func testNetworks(n int) (*networkMap, *legacyMaps) {
+	rnd := rand.New(rand.NewSource(42))
+	ln := legacyNetworks{}
+	l := &legacyMaps{
+		employeePriv: map[string]*net.IPNet{},
+		employeePub:  map[string]*net.IPNet{},
+		companyPub:   map[string]*net.IPNet{},
+		reservedPriv: map[string]*net.IPNet{},
+		discard:      map[string]*net.IPNet{},
+	}
+
+	add := func(m map[string]*net.IPNet, fname, cidr string) {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		m[cidr] = ipnet
+		ln[fname] = append(ln[fname], legacyNetwork{network: ipnet, source: fname})
+	}
+
+	add(l.reservedPriv, `reserved.txt`, `10.0.0.0/8`)
+	add(l.reservedPriv, `reserved.txt`, `172.16.0.0/12`)
+	add(l.reservedPriv, `reserved.txt`, `fc00::/7`)
+	add(l.companyPub, `company-public.txt`, `198.18.0.0/15`)
+	add(l.companyPub, `company-public.txt`, `2001:db8::/32`)
+	for i := 0; i < n; i++ {
+		add(l.employeePriv, `employee-private.txt`, fmt.Sprintf("10.%d.%d.0/24",
+			rnd.Intn(256), rnd.Intn(256)))
+		add(l.employeePriv, `employee-private.txt`, fmt.Sprintf("fd00:%x:%x::/48",
+			rnd.Intn(65536), rnd.Intn(65536)))
+		add(l.employeePub, `employee-public.txt`, fmt.Sprintf("198.%d.%d.%d/28",
+			18+rnd.Intn(2), rnd.Intn(256), 16*rnd.Intn(16)))
+		add(l.employeePub, `employee-public.txt`, fmt.Sprintf("2001:db8:%x::/48",
+			rnd.Intn(65536)))
+		add(l.discard, `discard.txt`, fmt.Sprintf("%d.%d.%d.%d/32",
+			1+rnd.Intn(223), rnd.Intn(256), rnd.Intn(256), rnd.Intn(256)))
+	}
+	// employee networks outside of reserved and company networks
+	add(l.employeePriv, `employee-private.txt`, `192.168.0.0/16`)
+	add(l.employeePub, `employee-public.txt`, `198.16.0.0/13`)
+	add(l.reservedPriv, `reserved.txt`, `192.168.10.0/24`)
+
+	m := newNetworkMap()
+	ln.importInto(m, ``)
+	return m, l
+}
+
+// testAddresses generates n random IPv4 and IPv6 addresses, biased
+// towards the networks generated by testNetworks
+func testAddresses(n int) []net.IP {
+	rnd := rand.New(rand.NewSource(23))
+	ips := make([]net.IP, 0, n)
+	for i := 0; i < n; i++ {
+		var s string
+		switch i % 6 {
+		case 0:
+			s = fmt.Sprintf("10.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		case 1:
+			s = fmt.Sprintf("198.%d.%d.%d", 18+rnd.Intn(2), rnd.Intn(256), rnd.Intn(256))
+		case 2:
+			s = fmt.Sprintf("%d.%d.%d.%d", 1+rnd.Intn(223), rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		case 3:
+			s = fmt.Sprintf("fd00:%x:%x::%x", rnd.Intn(65536), rnd.Intn(65536), rnd.Intn(65536))
+		case 4:
+			s = fmt.Sprintf("2001:db8:%x::%x", rnd.Intn(65536), rnd.Intn(65536))
+		case 5:
+			s = fmt.Sprintf("2a00:%x::%x", rnd.Intn(65536), rnd.Intn(65536))
+		}
+		ips = append(ips, net.ParseIP(s).To16())
+	}
+	return ips
+}
+
+func TestNetworkMapMatchesLegacy(t *testing.T) {
+	m, legacy := testNetworks(500)
+	ips := testAddresses(20000)
+	for _, s := range []string{`192.168.10.1`, `192.168.11.1`, `198.17.0.1`, `198.18.0.1`} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	for _, ip := range ips {
+		got := m.classify(ip)
+		want := legacy.classify(ip)
+		if got != want {
+			t.Fatalf("%s: network map %s, legacy %s", ip, got, want)
+		}
+	}
+}
+
+func TestNetTrieMostSpecific(t *testing.T) {
+	trie := newNetTrie()
+	for i, cidr := range []string{`10.0.0.0/8`, `10.1.0.0/16`, `10.1.2.0/24`, `10.1.3.0/24`} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		trie.Insert(&policyEntry{Network: ipnet, Class: classInfrastructure, order: i})
+	}
+	for _, c := range []struct {
+		ip, want string
+		matches  int
+	}{
+		{`10.1.2.3`, `10.1.2.0/24`, 3},
+		{`10.1.4.1`, `10.1.0.0/16`, 2},
+		{`10.2.0.1`, `10.0.0.0/8`, 1},
+	} {
+		e := trie.Lookup(net.ParseIP(c.ip))
+		if e == nil || e.Network.String() != c.want {
+			t.Errorf("%s: got %v, want %s", c.ip, e, c.want)
+		}
+		if n := len(trie.Matches(net.ParseIP(c.ip))); n != c.matches {
+			t.Errorf("%s: got %d matches, want %d", c.ip, n, c.matches)
+		}
+	}
+	if e := trie.Lookup(net.ParseIP(`11.0.0.1`)); e != nil {
+		t.Errorf("11.0.0.1: unexpected match %v", e.Network)
+	}
+	if trie.Len() != 4 {
+		t.Errorf("Len: got %d, want 4", trie.Len())
+	}
+}
+
+func benchmarkClassify(b *testing.B, classify func(net.IP) string) {
+	ips := testAddresses(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// one record, both sides
+		src := ips[i%len(ips)]
+		dst := ips[(i+1)%len(ips)]
+		classify(src)
+		classify(dst)
+	}
+}
+
+func BenchmarkClassify(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		m, legacy := testNetworks(n)
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			benchmarkClassify(b, m.classify)
+		})
+		b.Run(fmt.Sprintf("maps/%d", n), func(b *testing.B) {
+			benchmarkClassify(b, legacy.classify)
+		})
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,195 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// NetworkConfig describes where the network maps are read from
+type NetworkConfig struct {
+	// VersionsFile lists the network map versions, it replaces the
+	// other files if set
+	VersionsFile string
+	// PolicyFile, or the legacy network files within Path if no
+	// policy file is set
+	PolicyFile string
+	Path       string
+	// InventoryFile is optional
+	InventoryFile string
+}
+
+// NetworkConfigFromEnv returns the network configuration of the
+// daemon
+func NetworkConfigFromEnv() NetworkConfig {
+	return NetworkConfig{
+		VersionsFile:  os.Getenv(`PRIVACY_NETWORKMAP_VERSIONS`),
+		PolicyFile:    os.Getenv(`PRIVACY_POLICY_FILE`),
+		Path:          os.Getenv(`PRIVACY_NETWORKFILE_PATH`),
+		InventoryFile: os.Getenv(`PRIVACY_INVENTORY_FILE`),
+	}
+}
+
+// networkStore holds all versions of the network maps, ordered by the
+// time they became effective
+type networkStore struct {
+	versions []*networkMap
+}
+
+// at returns the network map effective at time t
+func (s *networkStore) at(t time.Time) *networkMap {
+	i := sort.Search(len(s.versions), func(i int) bool {
+		return s.versions[i].effective.After(t)
+	})
+	if i == 0 {
+		return s.versions[0]
+	}
+	return s.versions[i-1]
+}
+
+// current returns the network map effective now
+func (s *networkStore) current() *networkMap {
+	return s.at(time.Now())
+}
+
+// versionsFile is the JSON representation of a versions file, its
+// format is described in README.md
+type versionsFile struct {
+	Versions []versionsFileEntry `json:"versions"`
+}
+
+type versionsFileEntry struct {
+	ID        string    `json:"id,omitempty"`
+	Effective time.Time `json:"effective"`
+	Policy    string    `json:"policy,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Inventory string    `json:"inventory,omitempty"`
+	// source describes the position of the version
+	source string
+}
+
+// loadNetworkStore reads all network maps of cfg. It returns the
+// store, the files it was read from and a description of the source.
+func loadNetworkStore(cfg NetworkConfig) (*networkStore, []string, string, error) {
+	if cfg.VersionsFile == `` {
+		m, files, source, err := loadNetworkMaps(cfg.PolicyFile, cfg.Path, cfg.InventoryFile)
+		if err != nil {
+			return nil, files, source, err
+		}
+		m.setVersion(fileDigest(files), time.Time{})
+		return &networkStore{versions: []*networkMap{m}}, files, source, nil
+	}
+
+	fname := cfg.VersionsFile
+	files := []string{fname}
+	versions, err := parseVersionsFile(fname)
+	if err != nil {
+		return nil, files, fname, err
+	}
+
+	s := &networkStore{}
+	ids := map[string]bool{}
+	for _, v := range versions {
+		m, vfiles, _, err := loadNetworkMaps(v.Policy, v.Path, v.Inventory)
+		files = append(files, vfiles...)
+		if err != nil {
+			return nil, files, fname, err
+		}
+		id := v.ID
+		if id == `` {
+			id = fileDigest(vfiles)
+		}
+		if ids[id] {
+			return nil, files, fname, errAt(v.source, fmt.Sprintf("duplicate version %s", id))
+		}
+		ids[id] = true
+		m.setVersion(id, v.Effective)
+		s.versions = append(s.versions, m)
+	}
+
+	sort.SliceStable(s.versions, func(i, j int) bool {
+		return s.versions[i].effective.Before(s.versions[j].effective)
+	})
+	for i := 1; i < len(s.versions); i++ {
+		if s.versions[i].effective.Equal(s.versions[i-1].effective) {
+			return nil, files, fname, errAt(fname, fmt.Sprintf(
+				"versions %s and %s are effective at the same time",
+				s.versions[i-1].version, s.versions[i].version))
+		}
+	}
+	return s, files, fname, nil
+}
+
+// parseVersionsFile parses the versions file fname. The files of the
+// versions are resolved relative to it.
+func parseVersionsFile(fname string) ([]versionsFileEntry, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	vf := versionsFile{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&vf); err != nil {
+		return nil, jsonError(fname, data, err)
+	}
+	if len(vf.Versions) == 0 {
+		return nil, errAt(fname, `no versions configured`)
+	}
+
+	relative := func(f string) string {
+		if f == `` || filepath.IsAbs(f) {
+			return f
+		}
+		return filepath.Join(filepath.Dir(fname), f)
+	}
+
+	for i := range vf.Versions {
+		v := &vf.Versions[i]
+		v.source = fmt.Sprintf("%s: version %d", fname, i+1)
+		if (v.Policy == ``) == (v.Path == ``) {
+			return nil, errAt(v.source, `exactly one of policy and path is required`)
+		}
+		if v.Effective.IsZero() {
+			return nil, errAt(v.source, `no effective time configured`)
+		}
+		v.Policy, v.Path, v.Inventory = relative(v.Policy), relative(v.Path), relative(v.Inventory)
+	}
+	return vf.Versions, nil
+}
+
+// setVersion sets the version ID and effective time of m and all its
+// scopes
+func (m *networkMap) setVersion(id string, effective time.Time) {
+	m.version, m.effective = id, effective
+	for _, sm := range m.scopes {
+		sm.version, sm.effective = id, effective
+	}
+}
+
+// fileDigest returns a digest of the contents of files
+func fileDigest(files []string) string {
+	h := sha256.New()
+	for _, fname := range files {
+		data, _ := ioutil.ReadFile(fname)
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(fname), len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,76 @@
+/*-
+ * Copyright (c) 2021, Jörg Pernfuß
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package privacy // import "github.com/mjolnir42/privprod/internal/privacy"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNetworkStoreVersions(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `privprod`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) string {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	write(`old.json`, `{"networks": [{"prefix": "10.0.0.0/8", "class": "partner"}]}`)
+	write(`new.json`, `{"networks": [{"prefix": "10.0.0.0/8", "class": "infrastructure"}]}`)
+	versions := write(`versions.json`, `{"versions": [
+		{"id": "new", "effective": "2021-07-01T00:00:00Z", "policy": "new.json"},
+		{"id": "old", "effective": "2021-01-01T00:00:00Z", "policy": "old.json"}
+	]}`)
+
+	s, files, _, err := loadNetworkStore(NetworkConfig{VersionsFile: versions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("tracking %d files, want 3", len(files))
+	}
+
+	ip := mustCIDR(`10.1.2.3/32`).IP
+	for _, c := range []struct {
+		at, version, class string
+	}{
+		{`2020-06-01T00:00:00Z`, `old`, classPartner},
+		{`2021-01-01T00:00:00Z`, `old`, classPartner},
+		{`2021-06-30T23:59:59Z`, `old`, classPartner},
+		{`2021-07-01T00:00:00Z`, `new`, classInfrastructure},
+		{`2022-01-01T00:00:00Z`, `new`, classInfrastructure},
+	} {
+		ts, _ := time.Parse(time.RFC3339, c.at)
+		m := s.at(ts)
+		if m.version != c.version {
+			t.Errorf("%s: version %s, want %s", c.at, m.version, c.version)
+		}
+		if e := m.lookup(ip); e.Class != c.class {
+			t.Errorf("%s: classified as %s, want %s", c.at, e.Class, c.class)
+		}
+	}
+
+	write(`versions.json`, `{"versions": [
+		{"id": "a", "effective": "2021-07-01T00:00:00Z", "policy": "new.json"},
+		{"id": "b", "effective": "2021-07-01T00:00:00Z", "policy": "old.json"}
+	]}`)
+	if _, _, _, err := loadNetworkStore(NetworkConfig{VersionsFile: versions}); err == nil {
+		t.Errorf("accepted two versions with the same effective time")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix